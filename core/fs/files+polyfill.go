@@ -7,3 +7,8 @@ import "os"
 
 func CloseOnExec(*os.File) {
 }
+
+// TryLockFile is a no-op on platforms without flock support.
+func TryLockFile(*os.File) error {
+	return nil
+}
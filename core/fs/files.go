@@ -14,3 +14,10 @@ func CloseOnExec(file *os.File) {
 		syscall.CloseOnExec(int(file.Fd()))
 	}
 }
+
+// TryLockFile places a non-blocking exclusive advisory lock on file,
+// returning an error when another process already holds the lock.
+// The lock is released when the file is closed.
+func TryLockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -1,23 +1,72 @@
 package logx
 
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
 type LogRotationRuleType int
 
 const (
 	LogRotationRuleTypeDaily LogRotationRuleType = iota
 	LogRotationRuleTypeSizeLimit
+	LogRotationRuleTypeMonthly
+	LogRotationRuleTypeCron
+	LogRotationRuleTypeHourly
+	LogRotationRuleTypeWeekly
 )
 
 // A LogConf is a logging config.
 type LogConf struct {
-	ServiceName         string `json:",optional"`
-	Mode                string `json:",default=console,options=[console,file,volume]"`
-	Encoding            string `json:",default=json,options=[json,plain]"`
-	TimeFormat          string `json:",optional"`
-	Path                string `json:",default=logs"`
-	Level               string `json:",default=info,options=[info,error,severe]"`
-	Compress            bool   `json:",optional"`
-	KeepDays            int    `json:",optional"`
-	StackCooldownMillis int    `json:",default=100"`
+	ServiceName string `json:",optional"`
+	Mode        string `json:",default=console,options=[console,file,volume]"`
+	Encoding    string `json:",default=json,options=[json,plain]"`
+	TimeFormat  string `json:",optional"`
+	Path        string `json:",default=logs"`
+	Level       string `json:",default=info,options=[info,error,severe]"`
+	Compress    bool   `json:",optional"`
+	// BufferSize is how many pending writes each log file buffers before
+	// writes block, trading memory for burst absorption. Zero is treated
+	// as the default of 100.
+	BufferSize int `json:",default=100"`
+	// CompressConcurrency bounds how many post-rotate compressions and
+	// cleanups may run at the same time, keeping rotation bursts from
+	// spiking CPU. Zero is treated as the default of 1.
+	CompressConcurrency int `json:",default=1"`
+	// CompressLevel is the gzip compression level of rotated backups, from
+	// gzip.HuffmanOnly (-2) to gzip.BestCompression (9). The default matches
+	// gzip.DefaultCompression, and zero is treated as unset.
+	// Only take effect when Compress is enabled.
+	CompressLevel int `json:",default=-1"`
+	// CompressExisting compresses, in the background on startup, the
+	// uncompressed backups left behind from before compression was enabled.
+	// It's opt-in to avoid a startup CPU spike on many legacy backups.
+	// Only take effect when Compress is enabled.
+	CompressExisting bool `json:",optional"`
+	// CompressAfter keeps the given number of the most recent backups
+	// uncompressed, so the immediately-previous log stays easy to tail and
+	// grep. Zero compresses every backup right after rotation.
+	// Only take effect when Compress is enabled.
+	CompressAfter int `json:",optional"`
+	KeepDays      int `json:",optional"`
+	// KeepMonths retains the backups of the most recent calendar months,
+	// taking precedence over KeepDays.
+	// Only take effect when RotationRuleType is `LogRotationRuleTypeMonthly`
+	KeepMonths int `json:",optional"`
+	// KeepHours retains the backups of the most recent hours, for size-based
+	// rotation too high-volume for day-granularity retention. When both
+	// KeepDays and KeepHours are set, the stricter (smaller) window wins.
+	// MaxBackups applies independently: a backup is deleted once either the
+	// count cap or the age window evicts it.
+	// Only take effect when RotationRuleType is `LogRotationRuleTypeSizeLimit`
+	KeepHours int `json:",optional"`
+	// KeepDuration retains the backups of the given age window, e.g. "36h",
+	// for retention finer than whole days. When set it overrides KeepDays;
+	// KeepDays stays supported for backward compatibility.
+	KeepDuration        time.Duration `json:",optional"`
+	StackCooldownMillis int           `json:",default=100"`
 	// MaxBackups represents how many backup log files will be kept. 0 means all files will be kept forever.
 	// Only take effect when RotationRuleType is `LogRotationRuleTypeSizeLimit`
 	// NOTE: the level of option `KeepDays` will be higher. Even thougth `MaxBackups` sets 0, log files will
@@ -26,8 +75,104 @@ type LogConf struct {
 	// MaxSize represents how much space the writing log file takes up. 0 means no limit. The unit is `MB`.
 	// Only take effect when RotationRuleType is `LogRotationRuleTypeSizeLimit`
 	MaxSize int `json:",default=0"`
+	// MaxTotalSize represents how much space all the backups of a log file may take up together.
+	// 0 means no limit. The unit is `MB`. The newest backups within the budget are kept.
+	// Only take effect when RotationRuleType is `LogRotationRuleTypeSizeLimit`
+	MaxTotalSize int `json:",default=0"`
 	// RotationRuleType represents the type of log rotation rule. Default is DailyRotateRule.
 	// 0: LogRotationRuleTypeDaily
 	// 1: LogRotationRuleTypeSizeLimit
-	RotationRuleType LogRotationRuleType `json:",default=0,options=[0,1]"`
+	// 2: LogRotationRuleTypeMonthly
+	// 3: LogRotationRuleTypeCron
+	// 4: LogRotationRuleTypeHourly
+	// 5: LogRotationRuleTypeWeekly
+	RotationRuleType LogRotationRuleType `json:",default=0,options=[0,1,2,3,4,5]"`
+	// RotationCronSpec is the standard five-field cron spec driving the rotations.
+	// Only take effect when RotationRuleType is `LogRotationRuleTypeCron`
+	RotationCronSpec string `json:",optional"`
+	// UTC makes all the backup timestamps render in UTC instead of local time,
+	// keeping the names ordered consistently across hosts in different timezones.
+	UTC bool `json:",optional"`
+	// SymlinkCurrent keeps a `.current` symlink next to each log file pointing
+	// at the newest backup, giving log shippers a fixed path to tail.
+	SymlinkCurrent bool `json:",optional"`
+	// RotationMarker writes a structured marker as the first line of each
+	// freshly rotated log file, e.g. {"_rotated":"old->new","@timestamp":...},
+	// so downstream parsers see rotation boundaries in-band. The marker
+	// follows the configured Encoding.
+	RotationMarker bool `json:",optional"`
+	// Exclusive takes an advisory flock on each log file, so a second process
+	// pointed at the same filename fails to start instead of interleaving
+	// appends and racing rotations. The lock is advisory, platforms and
+	// filesystems without flock support silently skip it.
+	Exclusive bool `json:",optional"`
+	// Synchronous makes every write hit the disk before returning, for
+	// low-volume audit logs that must survive a process kill. Each line
+	// costs a disk round trip, so throughput drops by orders of magnitude
+	// compared to the buffered default.
+	Synchronous bool `json:",optional"`
+	// RepairOnOpen checks the last line of each existing log file on startup
+	// and fixes a partial record a crash mid-write left behind, so downstream
+	// parsers don't choke on it. Only takes effect when Encoding is `json`.
+	RepairOnOpen bool `json:",optional"`
+	// FileMode is the octal permission of created log files, e.g. "0640" for
+	// group-readable files. Empty keeps the default of 0600 for rotated files.
+	FileMode string `json:",optional"`
+	// DirMode is the octal permission of created log directories, e.g. "0750".
+	// Empty keeps the default of 0755.
+	DirMode string `json:",optional"`
+}
+
+// Validate validates c, rejecting negative rotation values that would lead to
+// surprising retention behavior, like deleting all the backup files.
+func (c LogConf) Validate() error {
+	if c.KeepDays < 0 {
+		return ErrNegativeKeepDays
+	}
+	if c.KeepMonths < 0 {
+		return ErrNegativeKeepMonths
+	}
+	if c.KeepHours < 0 {
+		return ErrNegativeKeepHours
+	}
+	if c.KeepDuration < 0 {
+		return ErrNegativeKeepDuration
+	}
+	if c.MaxBackups < 0 {
+		return ErrNegativeMaxBackups
+	}
+	if c.MaxSize < 0 {
+		return ErrNegativeMaxSize
+	}
+	if c.MaxTotalSize < 0 {
+		return ErrNegativeMaxTotalSize
+	}
+	if c.RotationRuleType == LogRotationRuleTypeCron {
+		if _, err := parseCronSpec(c.RotationCronSpec); err != nil {
+			return err
+		}
+	}
+	if _, err := parseFileMode(c.FileMode); err != nil {
+		return err
+	}
+	if _, err := parseFileMode(c.DirMode); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseFileMode parses an octal permission string like "0640",
+// an empty string means unset.
+func parseFileMode(s string) (os.FileMode, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode %q: %w", s, err)
+	}
+
+	return os.FileMode(mode), nil
 }
@@ -0,0 +1,14 @@
+package logx
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogConfValidate(t *testing.T) {
+	assert.Nil(t, LogConf{}.Validate())
+	assert.Equal(t, ErrNegativeKeepDays, LogConf{KeepDays: -7}.Validate())
+	assert.Equal(t, ErrNegativeMaxBackups, LogConf{MaxBackups: -1}.Validate())
+	assert.Equal(t, ErrNegativeMaxSize, LogConf{MaxSize: -1}.Validate())
+}
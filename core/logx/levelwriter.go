@@ -0,0 +1,53 @@
+package logx
+
+import (
+	"bytes"
+	"io"
+)
+
+// levelWriter prefixes each line it forwards with a level token, tagging the
+// output of sub-loggers that share one underlying writer.
+type levelWriter struct {
+	writer io.Writer
+	prefix []byte
+	// whether the previous write stopped in the middle of a line, so the
+	// continuation in the next write is not prefixed again
+	midLine bool
+}
+
+// LevelWriter returns an io.Writer that prepends level to every line written
+// through it before delegating to w. A write that doesn't end in a newline
+// leaves the line open, its continuation in a later write stays unprefixed.
+func LevelWriter(w io.Writer, level string) io.Writer {
+	return &levelWriter{
+		writer: w,
+		prefix: []byte(level + " "),
+	}
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	rest := p
+	for len(rest) > 0 {
+		if !w.midLine {
+			buf.Write(w.prefix)
+		}
+
+		idx := bytes.IndexByte(rest, '\n')
+		if idx < 0 {
+			buf.Write(rest)
+			w.midLine = true
+			break
+		}
+
+		buf.Write(rest[:idx+1])
+		w.midLine = false
+		rest = rest[idx+1:]
+	}
+
+	if _, err := w.writer.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
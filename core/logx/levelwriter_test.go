@@ -0,0 +1,31 @@
+package logx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevelWriter(t *testing.T) {
+	var builder strings.Builder
+	w := LevelWriter(&builder, "[info]")
+	n, err := w.Write([]byte("hello\nworld\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 12, n)
+	assert.Equal(t, "[info] hello\n[info] world\n", builder.String())
+}
+
+func TestLevelWriterPartialLines(t *testing.T) {
+	var builder strings.Builder
+	w := LevelWriter(&builder, "[warn]")
+
+	// a line spread over several writes is only prefixed once
+	_, err := w.Write([]byte("hel"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("lo\nnext"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "[warn] hello\n[warn] next\n", builder.String())
+}
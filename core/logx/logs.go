@@ -39,11 +39,31 @@ type (
 
 	logOptions struct {
 		gzipEnabled           bool
+		gzipLevel             int
+		gzipLevelSet          bool
+		compressConcurrency   int
+		compressAfter         int
+		compressExisting      bool
 		logStackCooldownMills int
 		keepDays              int
+		keepMonths            int
+		keepHours             int
+		keepDuration          time.Duration
 		maxBackups            int
 		maxSize               int
+		maxTotalSize          int
 		rotationRule          LogRotationRuleType
+		rotationCronSpec      string
+		backupQualifier       string
+		symlinkCurrent        bool
+		rotationMarker        bool
+		utc                   bool
+		exclusive             bool
+		repairOnOpen          bool
+		synchronous           bool
+		bufferSize            int
+		fileMode              os.FileMode
+		dirMode               os.FileMode
 	}
 
 	// LogField is a key-value pair that will be added to the log entry.
@@ -212,6 +232,10 @@ func SetWriter(w Writer) {
 // we need to allow different service frameworks to initialize logx respectively.
 // the same logic for SetUp
 func SetUp(c LogConf) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
 	setupLogLevel(c)
 
 	if len(c.TimeFormat) > 0 {
@@ -290,6 +314,31 @@ func WithKeepDays(days int) LogOption {
 	}
 }
 
+// WithKeepMonths customizes how many calendar months of backups will be kept,
+// taking precedence over the keeping days for the monthly rotation rule.
+func WithKeepMonths(months int) LogOption {
+	return func(opts *logOptions) {
+		opts.keepMonths = months
+	}
+}
+
+// WithKeepHours customizes the retention window of the size-limited rotation
+// rule in hours, the stricter of this and the keeping days wins.
+func WithKeepHours(hours int) LogOption {
+	return func(opts *logOptions) {
+		opts.keepHours = hours
+	}
+}
+
+// WithKeepDuration customizes the retention window as a duration, e.g. 36
+// hours, for retention finer than whole days. When set it overrides the
+// keeping days.
+func WithKeepDuration(d time.Duration) LogOption {
+	return func(opts *logOptions) {
+		opts.keepDuration = d
+	}
+}
+
 // WithGzip customizes logging to automatically gzip the log files.
 func WithGzip() LogOption {
 	return func(opts *logOptions) {
@@ -297,6 +346,41 @@ func WithGzip() LogOption {
 	}
 }
 
+// WithGzipLevel customizes the gzip compression level of the rotated backups,
+// from gzip.HuffmanOnly to gzip.BestCompression.
+func WithGzipLevel(level int) LogOption {
+	return func(opts *logOptions) {
+		opts.gzipLevel = level
+		opts.gzipLevelSet = true
+	}
+}
+
+// WithCompressConcurrency customizes how many post-rotate compressions and
+// cleanups may run at the same time. Zero or negative is treated as the
+// default of 1.
+func WithCompressConcurrency(n int) LogOption {
+	return func(opts *logOptions) {
+		opts.compressConcurrency = n
+	}
+}
+
+// WithCompressAfter customizes how many of the most recent backups stay
+// uncompressed, keeping the immediately-previous log easy to read.
+func WithCompressAfter(n int) LogOption {
+	return func(opts *logOptions) {
+		opts.compressAfter = n
+	}
+}
+
+// WithCompressExisting customizes logging to compress, in the background on
+// startup, the uncompressed backups left behind from before compression was
+// enabled.
+func WithCompressExisting() LogOption {
+	return func(opts *logOptions) {
+		opts.compressExisting = true
+	}
+}
+
 // WithMaxBackups customizes how many log files backups will be kept.
 func WithMaxBackups(count int) LogOption {
 	return func(opts *logOptions) {
@@ -311,6 +395,23 @@ func WithMaxSize(size int) LogOption {
 	}
 }
 
+// WithMaxTotalSize customizes how much space all the backups of a log file
+// may take up together.
+func WithMaxTotalSize(size int) LogOption {
+	return func(opts *logOptions) {
+		opts.maxTotalSize = size
+	}
+}
+
+// WithBackupQualifier customizes the qualifier spliced into backup filenames,
+// so replicas sharing one mounted volume never collide on backups and their
+// retention only matches their own files. Volume mode sets it to the hostname.
+func WithBackupQualifier(qualifier string) LogOption {
+	return func(opts *logOptions) {
+		opts.backupQualifier = qualifier
+	}
+}
+
 // WithLogRotationRuleType customizes which log rotation rule to use.
 func WithLogRotationRuleType(r LogRotationRuleType) LogOption {
 	return func(opts *logOptions) {
@@ -318,22 +419,193 @@ func WithLogRotationRuleType(r LogRotationRuleType) LogOption {
 	}
 }
 
+// WithLogRotationCronSpec customizes the cron spec driving the rotations,
+// only taking effect with LogRotationRuleTypeCron.
+func WithLogRotationCronSpec(spec string) LogOption {
+	return func(opts *logOptions) {
+		opts.rotationCronSpec = spec
+	}
+}
+
+// WithLogBufferSize customizes how many pending writes each log file buffers
+// before writes block.
+func WithLogBufferSize(size int) LogOption {
+	return func(opts *logOptions) {
+		opts.bufferSize = size
+	}
+}
+
+// WithLogFileMode customizes the permission of created log files,
+// zero keeps the defaults.
+func WithLogFileMode(mode os.FileMode) LogOption {
+	return func(opts *logOptions) {
+		opts.fileMode = mode
+	}
+}
+
+// WithLogDirMode customizes the permission of created log directories,
+// zero keeps the default of 0o755.
+func WithLogDirMode(mode os.FileMode) LogOption {
+	return func(opts *logOptions) {
+		opts.dirMode = mode
+	}
+}
+
+// WithSymlinkCurrent customizes logging to keep a .current symlink next to
+// each log file pointing at its newest backup.
+func WithSymlinkCurrent() LogOption {
+	return func(opts *logOptions) {
+		opts.symlinkCurrent = true
+	}
+}
+
+// WithRotationMarker customizes logging to write a structured marker as the
+// first line of each freshly rotated log file, so downstream parsers see
+// rotation boundaries in-band.
+func WithRotationMarker() LogOption {
+	return func(opts *logOptions) {
+		opts.rotationMarker = true
+	}
+}
+
+// WithExclusive customizes logging to take an advisory flock on each log
+// file, so a second process pointed at the same filename fails to start
+// instead of interleaving appends with this one.
+func WithExclusive() LogOption {
+	return func(opts *logOptions) {
+		opts.exclusive = true
+	}
+}
+
+// WithRepairOnOpen customizes logging to fix the partial last line a crash
+// mid-write may have left in an existing log file before appends resume.
+// Only takes effect with the json encoding.
+func WithRepairOnOpen() LogOption {
+	return func(opts *logOptions) {
+		opts.repairOnOpen = true
+	}
+}
+
+// WithSynchronous customizes logging to write each line to disk before the
+// call returns, trading throughput for durability on process kills.
+func WithSynchronous() LogOption {
+	return func(opts *logOptions) {
+		opts.synchronous = true
+	}
+}
+
+// WithUTC customizes logging to format all the backup timestamps in UTC,
+// keeping the names ordered consistently across hosts in different timezones.
+func WithUTC() LogOption {
+	return func(opts *logOptions) {
+		opts.utc = true
+	}
+}
+
 func createOutput(path string) (io.WriteCloser, error) {
 	if len(path) == 0 {
 		return nil, ErrLogPathNotSet
 	}
 
+	var rule RotateRule
 	switch options.rotationRule {
-	case LogRotationRuleTypeDaily:
-		return NewLogger(path, DefaultRotateRule(path, backupFileDelimiter, options.keepDays,
-			options.gzipEnabled), options.gzipEnabled)
 	case LogRotationRuleTypeSizeLimit:
-		return NewLogger(path, NewSizeLimitRotateRule(path, backupFileDelimiter, options.keepDays,
-			options.maxSize, options.maxBackups, options.gzipEnabled), options.gzipEnabled)
+		sized := NewSizeLimitRotateRule(path, backupFileDelimiter, options.keepDays,
+			options.maxSize, options.maxBackups, options.maxTotalSize,
+			options.gzipEnabled).(*SizeLimitRotateRule)
+		if options.keepHours > 0 {
+			sized.SetKeepHours(options.keepHours)
+		}
+		rule = sized
+	case LogRotationRuleTypeMonthly:
+		monthly := NewMonthlyRotateRule(path, backupFileDelimiter, options.keepDays,
+			options.gzipEnabled).(*MonthlyRotateRule)
+		if options.keepMonths > 0 {
+			monthly.SetKeepMonths(options.keepMonths)
+		}
+		rule = monthly
+	case LogRotationRuleTypeHourly:
+		rule = NewHourlyRotateRule(path, backupFileDelimiter, options.keepDays,
+			options.gzipEnabled)
+	case LogRotationRuleTypeWeekly:
+		rule = NewWeeklyRotateRule(path, backupFileDelimiter, options.keepDays,
+			options.gzipEnabled)
+	case LogRotationRuleTypeCron:
+		var err error
+		if rule, err = NewCronRotateRule(path, backupFileDelimiter,
+			options.rotationCronSpec, options.keepDays, options.maxBackups,
+			options.gzipEnabled); err != nil {
+			return nil, err
+		}
 	default:
-		return NewLogger(path, DefaultRotateRule(path, backupFileDelimiter, options.keepDays,
-			options.gzipEnabled), options.gzipEnabled)
+		rule = DefaultRotateRule(path, backupFileDelimiter, options.keepDays,
+			options.gzipEnabled)
+	}
+
+	if len(options.backupQualifier) > 0 {
+		if qualified, ok := rule.(interface{ SetBackupQualifier(string) }); ok {
+			qualified.SetBackupQualifier(options.backupQualifier)
+		}
+	}
+
+	if options.keepDuration > 0 {
+		if durable, ok := rule.(interface{ SetKeepDuration(time.Duration) }); ok {
+			durable.SetKeepDuration(options.keepDuration)
+		}
+	}
+
+	if options.utc {
+		if zoned, ok := rule.(interface{ SetUTC(bool) }); ok {
+			zoned.SetUTC(true)
+			// re-mark so the remembered boundary is in the same zone as the
+			// later comparisons
+			rule.MarkRotated()
+		}
+	}
+
+	var rotateOpts []RotateLoggerOption
+	if options.gzipLevelSet {
+		rotateOpts = append(rotateOpts, WithCompressLevel(options.gzipLevel))
+	}
+	// one background job at a time by default, keeping rotation bursts from
+	// spiking CPU
+	if options.compressConcurrency > 0 {
+		rotateOpts = append(rotateOpts, WithBackgroundConcurrency(options.compressConcurrency))
+	} else {
+		rotateOpts = append(rotateOpts, WithBackgroundConcurrency(1))
+	}
+	if options.compressAfter > 0 {
+		rotateOpts = append(rotateOpts, WithKeepUncompressed(options.compressAfter))
+	}
+	if options.compressExisting {
+		rotateOpts = append(rotateOpts, WithLegacyCompression())
+	}
+	if options.symlinkCurrent {
+		rotateOpts = append(rotateOpts, WithCurrentSymlink())
+	}
+	if options.rotationMarker {
+		rotateOpts = append(rotateOpts, WithMarkerOnRotate())
+	}
+	if options.exclusive {
+		rotateOpts = append(rotateOpts, WithExclusiveLock())
 	}
+	if options.repairOnOpen {
+		rotateOpts = append(rotateOpts, WithTailRepair())
+	}
+	if options.synchronous {
+		rotateOpts = append(rotateOpts, WithSynchronousWrites())
+	}
+	if options.bufferSize > 0 {
+		rotateOpts = append(rotateOpts, WithBufferSize(options.bufferSize))
+	}
+	if options.fileMode != 0 {
+		rotateOpts = append(rotateOpts, WithFileMode(options.fileMode))
+	}
+	if options.dirMode != 0 {
+		rotateOpts = append(rotateOpts, WithDirMode(options.dirMode))
+	}
+
+	return NewLogger(path, rule, options.gzipEnabled, rotateOpts...)
 }
 
 func errorAnySync(v interface{}) {
@@ -621,6 +621,13 @@ func TestWithKeepDays(t *testing.T) {
 	assert.Equal(t, 1, opt.keepDays)
 }
 
+func TestWithCompressConcurrency(t *testing.T) {
+	fn := WithCompressConcurrency(2)
+	var opt logOptions
+	fn(&opt)
+	assert.Equal(t, 2, opt.compressConcurrency)
+}
+
 func BenchmarkCopyByteSliceAppend(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		var buf []byte
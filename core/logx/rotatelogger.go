@@ -1,7 +1,16 @@
 package logx
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,8 +19,12 @@ import (
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/zeromicro/go-zero/core/fs"
@@ -19,18 +32,81 @@ import (
 )
 
 const (
-	rfc3339DateFormat = time.RFC3339
-	dateFormat        = "2006-01-02"
-	hoursPerDay       = 24
-	bufferSize        = 100
-	defaultDirMode    = 0o755
-	defaultFileMode   = 0o600
-	gzipExt           = ".gz"
-	megabyte          = 1024 * 1024
+	rfc3339DateFormat     = time.RFC3339
+	dateFormat            = "2006-01-02"
+	hourFormat            = "2006-01-02T15"
+	monthFormat           = "2006-01"
+	hoursPerDay           = 24
+	daysPerWeek           = 7
+	bufferSize            = 100
+	defaultDirMode        = 0o755
+	defaultFileMode       = 0o600
+	defaultCopyBufferSize = 32 * 1024
+	gzipExt               = ".gz"
+	// stands in for the timestamp while probing a backup name template,
+	// it cannot appear in a filename
+	templateTimeSentinel = "\x00"
+	manifestExt          = ".manifest"
+	writerMarkerExt      = ".writer"
+	tombstoneExt         = ".tombstone"
+	trashDirName         = ".trash"
+	encExt               = ".enc"
+	currentLinkExt       = ".current"
+	megabyte             = 1024 * 1024
+
+	// the most bytes sampled to estimate the compression ratio of a backup
+	compressSampleSize = 32 * 1024
+
+	// how far the tail repair probes back for the final newline before
+	// falling back to reading the whole file
+	tailProbeBytes = 32 * 1024
+
+	// the sliding window size of the latency recorders
+	latencySampleCount = 512
+
+	watchInterval = time.Second
+	// how often outdated backups are swept independently of rotations
+	defaultCleanupInterval = time.Hour
+	// how long a partial write batch may wait for more messages by default
+	defaultBatchFlush = time.Millisecond * 100
+	// the most bytes buffered in memory while waiting for a lazy open to succeed
+	maxLazyPendingBytes = megabyte
+)
+
+var (
+	// ErrLogFileClosed is an error that indicates the log file is already closed.
+	ErrLogFileClosed = errors.New("error: log file closed")
+	// ErrImportUnsupported is an error that indicates the rotation rule
+	// cannot name backups for arbitrary times, so legacy files cannot be imported.
+	ErrImportUnsupported = errors.New("rotation rule does not support importing")
+	// ErrActiveWriter is an error that indicates another process still holds
+	// the log file, e.g. the previous pod during a rolling restart.
+	ErrActiveWriter = errors.New("another writer holds the log file")
+	// ErrExclusiveLock is an error that indicates the advisory lock on the
+	// log file is held by another process.
+	ErrExclusiveLock = errors.New("log file is locked by another process")
+	// ErrRuleFilenameMismatch is an error that indicates the rotation rule was
+	// built for a different filename than the logger writes to, so the backups
+	// and the retention would target different base names.
+	ErrRuleFilenameMismatch = errors.New("rotation rule filename mismatch")
+)
+
+// CompressConflictPolicy defines what to do when the compression target already exists.
+type CompressConflictPolicy int
+
+const (
+	// CompressConflictRename picks a unique name for the new archive,
+	// keeping the existing one.
+	CompressConflictRename CompressConflictPolicy = iota
+	// CompressConflictSkip keeps the existing archive and leaves the log file uncompressed.
+	CompressConflictSkip
 )
 
-// ErrLogFileClosed is an error that indicates the log file is already closed.
-var ErrLogFileClosed = errors.New("error: log file closed")
+// timeNow is declared as a variable to make rotation boundary tests deterministic.
+var timeNow = time.Now
+
+// osRename is declared as a variable to simulate cross-device renames in tests.
+var osRename = os.Rename
 
 type (
 	// A RotateRule interface is used to define the log rotating rules.
@@ -41,20 +117,275 @@ type (
 		ShallRotate(currentSize, writeLen int) bool
 	}
 
+	// A Compressor defines a compression codec for rotated log files.
+	Compressor interface {
+		// Compress compresses src into a new file, removing src on success,
+		// and returns the path of the compressed file.
+		Compress(src string) (dst string, err error)
+		// Extension returns the filename extension of the compressed files,
+		// including the leading dot.
+		Extension() string
+	}
+
+	// A BackupNamer defines the naming strategy of backup files,
+	// used by the rules on rotating and on matching backups for retention.
+	BackupNamer interface {
+		// Name returns the backup filename for base rotated at t with sequence seq.
+		Name(base string, t time.Time, seq int) string
+		// Parse extracts the rotation time and sequence from a backup filename,
+		// returning ok false if name is not a backup of base.
+		Parse(base, name string) (t time.Time, seq int, ok bool)
+	}
+
+	// A RotateError wraps a rotation failure together with the log file
+	// involved, delivered to the OnError callback of a RotateLogger.
+	RotateError struct {
+		Filename string
+		Err      error
+	}
+
+	// captureResult is the reply of a RotateAndCapture request to the worker.
+	captureResult struct {
+		data []byte
+		err  error
+	}
+
+	// pendingWrite is a buffer queued while the log file could not be opened,
+	// with the number of messages it holds, so the replay keeps the stats per
+	// message.
+	pendingWrite struct {
+		data  []byte
+		lines int64
+	}
+
+	// reconfigRequest carries the settings of a Reconfigure call to the worker.
+	reconfigRequest struct {
+		rule     RotateRule
+		compress bool
+		// keep the current compression setting, used by SetRule which only
+		// swaps the rule
+		keepCompress bool
+		done         chan lang.PlaceholderType
+	}
+
 	// A RotateLogger is a Logger that can rotate log files with given rules.
 	RotateLogger struct {
 		filename string
 		backup   string
 		fp       *os.File
 		channel  chan []byte
+		capture  chan chan captureResult
+		forced   chan chan error
+		reconf   chan reconfigRequest
 		done     chan lang.PlaceholderType
 		rule     RotateRule
 		compress bool
+		// guards rule and compress against a concurrent reconfigure, the
+		// worker is the only writer so it reads them directly
+		ruleLock sync.RWMutex
 		// can't use threading.RoutineGroup because of cycle import
 		waitGroup sync.WaitGroup
 		closeOnce sync.Once
 
-		currentSize int
+		currentSize        int
+		extraFlags         int
+		bufSize            int
+		fileMode           os.FileMode
+		dirMode            os.FileMode
+		recordSep          []byte
+		encryptionKey      []byte
+		copyBufferSize     int
+		copyBufferPool     sync.Pool
+		recreateOnMissing  bool
+		copyTruncate       bool
+		exclusive          bool
+		discardOnClosed    bool
+		compressExisting   bool
+		symlinkCurrent     bool
+		dropOnFull         bool
+		pruneEmptyBackups  bool
+		closeSummary       bool
+		compressOnClose    bool
+		compressAfter      int
+		compressConflict   CompressConflictPolicy
+		compressIORate     int
+		compressLevel      int
+		compressSkipRatio  float64
+		compressor         Compressor
+		compressorSelector func(size int64) Compressor
+		rotateGuard        func() bool
+		onRotate           func(oldFile, newFile string)
+		onError            func(err error)
+		onDelete           func(file string, size int64, err error)
+		trailer            func() []byte
+		rotationMarker     bool
+		repairOnOpen       bool
+		// synchronous writes bypass the channel and hit the disk inline,
+		// the lock serializes them with the worker's timer-driven file work
+		synchronous bool
+		syncLock    sync.Mutex
+		// manifest settings, lastManifestHash is only touched on rotation
+		manifest         bool
+		manifestChained  bool
+		lastManifestHash string
+		triggerFile      string
+		stats            rotateStats
+		rotateLatency    latencyRecorder
+		writeLatency     latencyRecorder
+		// memory buffer settings, the buffer itself is only touched by the worker
+		memBufSize       int
+		memFlushInterval time.Duration
+		memBuf           []byte
+		memBufLines      int64
+		// write batching settings, the batch itself is only touched by the worker
+		batchSize  int
+		batchFlush time.Duration
+		batchBuf   []byte
+		batchLines int64
+		// how often the worker fsyncs the log file, zero means never
+		flushInterval time.Duration
+		// how often outdated backups are swept independently of rotations,
+		// zero means the default of once per hour
+		cleanupInterval time.Duration
+		// how often the worker checks the rule for a passed rotation boundary
+		// without waiting for a write, zero disables the check
+		rotateCheckInterval time.Duration
+		// restart overlap settings, markerOwned is only touched on init and Close
+		overlapTimeout time.Duration
+		markerOwned    bool
+		// how long trashed files are kept before being hard-deleted,
+		// zero means outdated files are removed immediately
+		trashGrace time.Duration
+		// lazy open settings, pending is only touched by the worker
+		lazyRetry    time.Duration
+		pending      []pendingWrite
+		pendingBytes int
+		streamGzip   bool
+		gzStream     *gzip.Writer
+		// bounds all background compression and deletion work, nil means unbounded
+		bgWorkers chan lang.PlaceholderType
+		// paths of backups currently being compressed and their growing
+		// archives, retention skips them so an overlapping sweep never
+		// deletes a half-written file
+		inFlight     map[string]lang.PlaceholderType
+		inFlightLock sync.Mutex
+		// the most recently sealed backup, retention never deletes it even
+		// when it momentarily sorts as the oldest, e.g. with maxBackups of 1
+		lastBackup     string
+		lastBackupLock sync.Mutex
+		// bounds the concurrently open backup streams, nil means unbounded
+		streamSem chan lang.PlaceholderType
+		// adaptive sampling settings, the counters are accessed atomically
+		sampleThreshold int
+		consecutiveFull int32
+		sampling        int32
+		sampleCounter   int64
+		// number of in-progress rotations and post-rotate background jobs,
+		// accessed atomically
+		rotating int32
+		// set once Close begins, makes the closed branch of Write deterministic
+		closing int32
+		// set while rotation is paused, accessed atomically
+		paused int32
+		// set once the symlink fallback warning has been logged, accessed atomically
+		symlinkWarned int32
+	}
+
+	// RotateLoggerOption defines the method to customize a RotateLogger.
+	RotateLoggerOption func(l *RotateLogger)
+
+	// backupPatterner is implemented by rules that can report the glob pattern
+	// matching their backup files.
+	backupPatterner interface {
+		backupPattern(compressed bool) string
+	}
+
+	// backupTimeNamer is implemented by rules that can name a backup
+	// for an arbitrary rotation time, used on importing legacy files.
+	backupTimeNamer interface {
+		backupFileNameAt(t time.Time) string
+	}
+
+	// dailyBackupNamer names backups the way DailyRotateRule does by default.
+	dailyBackupNamer struct {
+		delimiter string
+	}
+
+	// sizeBackupNamer names backups the way SizeLimitRotateRule does by default.
+	sizeBackupNamer struct {
+		delimiter string
+	}
+
+	// templateBackupNamer renders backup names from a user supplied
+	// text/template, bridging teams whose log-shipping tooling expects a
+	// naming scheme different from the built-in one.
+	templateBackupNamer struct {
+		tmpl *template.Template
+	}
+
+	// backupNameData is the data a backup name template renders,
+	// e.g. `{{.Prefix}}-{{.Time.Format "20060102"}}{{.Ext}}`.
+	backupNameData struct {
+		// Prefix is the log filename without directory and extension.
+		Prefix string
+		// Ext is the extension of the log filename, including the leading dot.
+		Ext string
+		// Time formats the rotation time, via its Format method.
+		Time interface{ Format(layout string) string }
+	}
+
+	// layoutProbe stands in for the rotation time while probing a backup name
+	// template, capturing the layout it formats the time with.
+	layoutProbe struct {
+		layout *string
+		calls  *int
+	}
+
+	// manifestRecord is one rotation record in the manifest file.
+	manifestRecord struct {
+		File string `json:"file"`
+		Time string `json:"time"`
+		Prev string `json:"prev,omitempty"`
+		Hash string `json:"hash,omitempty"`
+	}
+
+	// rotateStats holds the lifetime counters of a RotateLogger, accessed atomically.
+	rotateStats struct {
+		lines        int64
+		bytes        int64
+		rotations    int64
+		compressions int64
+		deletions    int64
+		dropped      int64
+		droppedBytes int64
+	}
+
+	// A LatencySnapshot reports percentiles over a sliding window of
+	// recorded durations.
+	LatencySnapshot struct {
+		P50 time.Duration
+		P95 time.Duration
+		Max time.Duration
+	}
+
+	// A RotateLoggerStats is a point-in-time view of the recorded
+	// distributions of a RotateLogger.
+	RotateLoggerStats struct {
+		// RotateDuration is the distribution of time spent in rotations,
+		// spotting e.g. slow renames on networked filesystems.
+		RotateDuration LatencySnapshot
+		// WriteLatency is the distribution of time writes spent enqueueing,
+		// spotting backpressure from a full write channel.
+		WriteLatency LatencySnapshot
+	}
+
+	// latencyRecorder keeps a sliding window of the most recent durations,
+	// from which percentile snapshots are computed on demand.
+	latencyRecorder struct {
+		lock    sync.Mutex
+		samples []time.Duration
+		next    int
+		full    bool
 	}
 
 	// A DailyRotateRule is a rule to daily rotate the log files.
@@ -62,100 +393,413 @@ type (
 		rotatedTime string
 		filename    string
 		delimiter   string
-		days        int
-		gzip        bool
+		qualifier   string
+		suffix      string
+		// the extension of compressed backups, empty means the built-in gzip
+		compressedExt string
+		days          int
+		// the age window as a duration, overriding the keeping days when set,
+		// for windows finer than whole days like 36 hours
+		keepDuration time.Duration
+		gzip         bool
+		debug        bool
+		utc          bool
+		timeTagged   bool
+		namer        BackupNamer
 	}
 
 	// SizeLimitRotateRule a rotation rule that make the log file rotated base on size
 	SizeLimitRotateRule struct {
 		DailyRotateRule
-		maxSize    int
-		maxBackups int
+		maxSize int
+		// the size limit in bytes, taking precedence over maxSize when set,
+		// for limits finer than 1MB
+		maxBytes int
+		// the age window in hours, the stricter of this and the keeping
+		// days wins when both are set
+		keepHours          int
+		maxBackups         int
+		maxTotalSize       int
+		timestampFormatter func(t time.Time) string
+	}
+
+	// A RetentionOnlyRotateRule never rotates the active file, but still
+	// reports outdated sibling backups so the logger cleans them up on a
+	// timer, decoupling retention from rotation entirely.
+	RetentionOnlyRotateRule struct {
+		SizeLimitRotateRule
+	}
+
+	// An HourlyRotateRule is a rule to rotate the log files at hour boundaries,
+	// keeping the files manageable for high-volume services.
+	HourlyRotateRule struct {
+		DailyRotateRule
+	}
+
+	// A MonthlyRotateRule is a rule to rotate the log files at calendar month boundaries.
+	MonthlyRotateRule struct {
+		DailyRotateRule
+		// how many months of backups to keep, taking precedence over the
+		// keeping days, computed on the calendar so variable month lengths
+		// don't skew the boundary
+		keepMonths int
+	}
+
+	// A WeeklyRotateRule is a rule to rotate the log files at ISO week
+	// boundaries, convenient for low-traffic files scanned by hand.
+	WeeklyRotateRule struct {
+		DailyRotateRule
+	}
+
+	// A DailySizeLimitRotateRule rotates at day boundaries like
+	// DailyRotateRule, and additionally splits the file whenever a single
+	// day exceeds the size limit. Same-day backups are disambiguated with
+	// a numeric sequence suffix.
+	DailySizeLimitRotateRule struct {
+		SizeLimitRotateRule
+	}
+
+	// A CronRotateRule rotates the log files on a wall-clock cron schedule,
+	// e.g. "0 0,12 * * 1-5" rotates at midnight and noon on weekdays only.
+	CronRotateRule struct {
+		SizeLimitRotateRule
+		schedule *cronSchedule
+		next     time.Time
+	}
+
+	// cronSchedule is a parsed five-field cron spec, one bit per allowed value.
+	cronSchedule struct {
+		minutes uint64
+		hours   uint64
+		doms    uint64
+		months  uint64
+		dows    uint64
+		domStar bool
+		dowStar bool
+	}
+
+	// A PeriodicSizeLimitRotateRule rotates the log file at fixed time boundaries,
+	// and splits it mid-period when the size limit is exceeded.
+	// The size budget restarts at every boundary.
+	PeriodicSizeLimitRotateRule struct {
+		SizeLimitRotateRule
+		granularity time.Duration
+		periodStart time.Time
 	}
 )
 
+// Error implements the error interface.
+func (e *RotateError) Error() string {
+	return fmt.Sprintf("failed to rotate log file %s: %s", e.Filename, e.Err)
+}
+
+// Unwrap returns the underlying cause, keeping errors.Is and errors.As working.
+func (e *RotateError) Unwrap() error {
+	return e.Err
+}
+
 // DefaultRotateRule is a default log rotating rule, currently DailyRotateRule.
 func DefaultRotateRule(filename, delimiter string, days int, gzip bool) RotateRule {
 	return &DailyRotateRule{
 		rotatedTime: getNowDate(),
 		filename:    filename,
-		delimiter:   delimiter,
-		days:        days,
+		delimiter:   safeDelimiter(delimiter),
+		days:        nonNegative(days, "days"),
 		gzip:        gzip,
 	}
 }
 
 // BackupFileName returns the backup filename on rotating.
 func (r *DailyRotateRule) BackupFileName() string {
-	return fmt.Sprintf("%s%s%s", r.filename, r.delimiter, getNowDate())
+	return r.backupFileNameAt(r.now())
+}
+
+func (r *DailyRotateRule) backupFileNameAt(t time.Time) string {
+	if r.namer != nil {
+		return r.namer.Name(r.filename, t, 0)
+	}
+
+	format := dateFormat
+	if r.timeTagged {
+		format = rfc3339DateFormat
+	}
+
+	return fmt.Sprintf("%s%s%s", r.filename, r.qualifiedDelimiter(), t.Format(format))
+}
+
+// SetBackupNamer customizes the backup naming strategy of r.
+func (r *DailyRotateRule) SetBackupNamer(namer BackupNamer) {
+	r.namer = namer
+}
+
+// Filename returns the log filename r was built for, letting the logger
+// verify the rule and the log file agree on the base name.
+func (r *DailyRotateRule) Filename() string {
+	return r.filename
+}
+
+// SetBackupQualifier qualifies the backup names of r with the given string,
+// typically the hostname. Replicas writing to one shared volume then never
+// collide on backup names, and retention only matches their own backups.
+func (r *DailyRotateRule) SetBackupQualifier(qualifier string) {
+	r.qualifier = qualifier
+}
+
+// SetCompressedExt tells r which extension the compression codec of the
+// logger produces, so the retention matches and compares the right backup
+// names. It defaults to the built-in gzip extension.
+func (r *DailyRotateRule) SetCompressedExt(ext string) {
+	r.compressedExt = ext
+}
+
+func (r *DailyRotateRule) compressedExtension() string {
+	if len(r.compressedExt) == 0 {
+		return gzipExt
+	}
+
+	return r.compressedExt
+}
+
+// SetBackupSuffix appends ext to the backup names r matches and compares,
+// e.g. ".enc" when backups are encrypted at rest after rotation, so the
+// retention still recognizes them.
+func (r *DailyRotateRule) SetBackupSuffix(ext string) {
+	r.suffix = ext
+}
+
+// SetRetentionDebug enables logging of every retention decision of r,
+// explaining why each backup file is kept or evicted. It's off by default
+// to avoid noise, turn it on when debugging unexpected deletions.
+func (r *DailyRotateRule) SetRetentionDebug(debug bool) {
+	r.debug = debug
+}
+
+func (r *DailyRotateRule) retentionDebug() bool {
+	return r.debug
+}
+
+// SetUTC makes r format and compare all the backup timestamps in UTC instead
+// of local time, keeping the names consistent across hosts in different
+// timezones. Call it right after construction, before the first rotation.
+func (r *DailyRotateRule) SetUTC(utc bool) {
+	r.utc = utc
+}
+
+// SetTimeTagged makes r include the rotation time in its backup names, so
+// two rotations on the same day, e.g. during a crash loop across restarts,
+// produce distinct backups instead of the second rename clobbering the first.
+// Date-only names stay the default, and retention recognizes both forms.
+func (r *DailyRotateRule) SetTimeTagged(tagged bool) {
+	r.timeTagged = tagged
+}
+
+func (r *DailyRotateRule) now() time.Time {
+	if r.utc {
+		return timeNow().UTC()
+	}
+
+	return timeNow()
+}
+
+func (r *DailyRotateRule) debugRetention(format string, v ...interface{}) {
+	if r.debug {
+		Infof(format, v...)
+	}
+}
+
+// qualifiedDelimiter returns the delimiter with the backup qualifier
+// spliced in, e.g. "-host-1-" for delimiter "-" and qualifier "host-1".
+func (r *DailyRotateRule) qualifiedDelimiter() string {
+	if len(r.qualifier) == 0 {
+		return r.delimiter
+	}
+
+	return r.delimiter + r.qualifier + r.delimiter
 }
 
 // MarkRotated marks the rotated time of r to be the current time.
 func (r *DailyRotateRule) MarkRotated() {
-	r.rotatedTime = getNowDate()
+	r.rotatedTime = r.now().Format(dateFormat)
+}
+
+// SetKeepDuration sets the age window of r as a duration, e.g. 36 hours, for
+// retention finer than whole days. When set it overrides the keeping days,
+// which stay supported for backward compatibility.
+func (r *DailyRotateRule) SetKeepDuration(d time.Duration) {
+	if d < 0 {
+		Errorf("keepDuration must be non-negative, got %s, fallback to 0", d)
+		return
+	}
+
+	r.keepDuration = d
+}
+
+// retention returns the effective age window, the keeping duration overrides
+// the keeping days when set. Zero means no age-based retention.
+func (r *DailyRotateRule) retention() time.Duration {
+	if r.keepDuration > 0 {
+		return r.keepDuration
+	}
+
+	return time.Duration(r.days*hoursPerDay) * time.Hour
+}
+
+// retentionWindow renders the effective age window for the retention debug
+// messages, in the unit it was configured in.
+func (r *DailyRotateRule) retentionWindow() string {
+	if r.keepDuration > 0 {
+		return r.keepDuration.String()
+	}
+
+	return fmt.Sprintf("%d days", r.days)
 }
 
 // OutdatedFiles returns the files that exceeded the keeping days.
 func (r *DailyRotateRule) OutdatedFiles() []string {
-	if r.days <= 0 {
+	keep := r.retention()
+	if keep <= 0 {
 		return nil
 	}
 
-	var pattern string
-	if r.gzip {
-		pattern = fmt.Sprintf("%s%s*%s", r.filename, r.delimiter, gzipExt)
-	} else {
-		pattern = fmt.Sprintf("%s%s*", r.filename, r.delimiter)
+	if r.namer != nil {
+		return outdatedFilesByNamer(r.namer, r.filename, int(keep/time.Hour), 0,
+			r.compressedExtension())
 	}
 
-	files, err := filepath.Glob(pattern)
+	files, err := filepath.Glob(r.backupPattern(r.gzip))
 	if err != nil {
 		Errorf("failed to delete outdated log files, error: %s", err)
 		return nil
 	}
 
 	var buf strings.Builder
-	boundary := time.Now().Add(-time.Hour * time.Duration(hoursPerDay*r.days)).Format(dateFormat)
-	fmt.Fprintf(&buf, "%s%s%s", r.filename, r.delimiter, boundary)
+	boundary := r.now().Add(-keep).Format(dateFormat)
+	fmt.Fprintf(&buf, "%s%s%s", r.filename, r.qualifiedDelimiter(), boundary)
 	if r.gzip {
-		buf.WriteString(gzipExt)
+		buf.WriteString(r.compressedExtension())
 	}
+	buf.WriteString(r.suffix)
 	boundaryFile := buf.String()
 
+	window := r.retentionWindow()
 	var outdates []string
 	for _, file := range files {
 		if file < boundaryFile {
+			r.debugRetention("retention: evicting %s, older than %s", file, window)
 			outdates = append(outdates, file)
+		} else {
+			r.debugRetention("retention: keeping %s, within %s", file, window)
 		}
 	}
 
 	return outdates
 }
 
+func (r *DailyRotateRule) backupPattern(compressed bool) string {
+	if compressed {
+		return fmt.Sprintf("%s%s*%s%s", r.filename, r.qualifiedDelimiter(),
+			r.compressedExtension(), r.suffix)
+	}
+
+	return fmt.Sprintf("%s%s*", r.filename, r.qualifiedDelimiter())
+}
+
 // ShallRotate checks if the file should be rotated.
 func (r *DailyRotateRule) ShallRotate(currentSize, writeLen int) bool {
-	return len(r.rotatedTime) > 0 && getNowDate() != r.rotatedTime
+	return len(r.rotatedTime) > 0 && r.now().Format(dateFormat) != r.rotatedTime
 }
 
-// NewSizeLimitRotateRule returns the rotation rule with size limit
-func NewSizeLimitRotateRule(filename, delimiter string, days, maxSize, maxBackups int, gzip bool) RotateRule {
+// NewSizeLimitRotateRule returns the rotation rule with size limit.
+// maxTotalSize caps the space all backups may take up together in MB,
+// zero means no budget.
+func NewSizeLimitRotateRule(filename, delimiter string, days, maxSize, maxBackups,
+	maxTotalSize int, gzip bool) RotateRule {
 	return &SizeLimitRotateRule{
 		DailyRotateRule: DailyRotateRule{
 			rotatedTime: getNowDateInRFC3339Format(),
 			filename:    filename,
-			delimiter:   delimiter,
-			days:        days,
+			delimiter:   safeDelimiter(delimiter),
+			days:        nonNegative(days, "days"),
 			gzip:        gzip,
 		},
-		maxSize:    maxSize,
-		maxBackups: maxBackups,
+		maxSize:      nonNegative(maxSize, "maxSize"),
+		maxBackups:   nonNegative(maxBackups, "maxBackups"),
+		maxTotalSize: nonNegative(maxTotalSize, "maxTotalSize"),
+	}
+}
+
+// NewSizeLimitRotateRuleWithError is NewSizeLimitRotateRule with the
+// delimiter validated up front, returning an error instead of silently
+// falling back to the default delimiter.
+func NewSizeLimitRotateRuleWithError(filename, delimiter string, days, maxSize, maxBackups,
+	maxTotalSize int, gzip bool) (RotateRule, error) {
+	if err := validateBackupDelimiter(delimiter); err != nil {
+		return nil, err
 	}
+
+	return NewSizeLimitRotateRule(filename, delimiter, days, maxSize, maxBackups,
+		maxTotalSize, gzip), nil
+}
+
+// NewSizeLimitRotateRuleBytes is NewSizeLimitRotateRule with the size limit
+// given in bytes instead of MB, for tiny embedded logs and tests that need
+// limits finer than 1MB.
+func NewSizeLimitRotateRuleBytes(filename, delimiter string, days, maxBytes, maxBackups,
+	maxTotalSize int, gzip bool) RotateRule {
+	rule := NewSizeLimitRotateRule(filename, delimiter, days, 0, maxBackups,
+		maxTotalSize, gzip).(*SizeLimitRotateRule)
+	rule.maxBytes = nonNegative(maxBytes, "maxBytes")
+
+	return rule
 }
 
 func (r *SizeLimitRotateRule) ShallRotate(currentSize, writeLen int) bool {
+	if r.maxBytes > 0 {
+		return r.maxBytes < currentSize+writeLen
+	}
+
 	return r.maxSize > 0 && r.maxSize*megabyte < currentSize+writeLen
 }
 
+// SetKeepHours customizes the retention window in hours, for high-volume
+// files where only the last few hours of backups matter. When both the
+// keeping days and hours are set, the stricter (smaller) window wins.
+// MaxBackups applies independently: a backup is deleted once either the
+// count cap or the age window evicts it.
+func (r *SizeLimitRotateRule) SetKeepHours(hours int) {
+	r.keepHours = nonNegative(hours, "keepHours")
+}
+
+// retentionHours returns the age window in hours, zero when no age-based
+// retention is configured.
+func (r *SizeLimitRotateRule) retentionHours() int {
+	hours := r.days * hoursPerDay
+	if r.keepDuration > 0 {
+		hours = int(r.keepDuration / time.Hour)
+	}
+	if r.keepHours > 0 && (hours == 0 || r.keepHours < hours) {
+		hours = r.keepHours
+	}
+
+	return hours
+}
+
+// SetTimestampFormatter customizes how r formats the backup timestamps,
+// e.g. UTC truncated to the minute. The default formats the plain current
+// time in RFC3339, without any offset applied. The formatted timestamps must
+// keep sorting chronologically, because retention compares them as strings.
+func (r *SizeLimitRotateRule) SetTimestampFormatter(formatter func(t time.Time) string) {
+	r.timestampFormatter = formatter
+}
+
+func (r *SizeLimitRotateRule) formatTimestamp(t time.Time) string {
+	if r.timestampFormatter != nil {
+		return r.timestampFormatter(t)
+	}
+
+	return t.Format(rfc3339DateFormat)
+}
+
 func (r *SizeLimitRotateRule) parseFilename(file string) (dir, logname, ext, prefix string) {
 	dir = filepath.Dir(r.filename)
 	logname = filepath.Base(r.filename)
@@ -165,30 +809,47 @@ func (r *SizeLimitRotateRule) parseFilename(file string) (dir, logname, ext, pre
 }
 
 func (r *SizeLimitRotateRule) BackupFileName() string {
+	return r.backupFileNameAt(r.now())
+}
+
+func (r *SizeLimitRotateRule) backupFileNameAt(t time.Time) string {
+	if r.namer != nil {
+		return r.namer.Name(r.filename, t, 0)
+	}
+
 	dir := filepath.Dir(r.filename)
 	_, _, ext, prefix := r.parseFilename(r.filename)
-	timestamp := getNowDateInRFC3339Format()
-	return filepath.Join(dir, fmt.Sprintf("%s%s%s%s", prefix, r.delimiter, timestamp, ext))
+	timestamp := r.formatTimestamp(t)
+	return filepath.Join(dir, fmt.Sprintf("%s%s%s%s", prefix, r.qualifiedDelimiter(), timestamp, ext))
 }
 
 func (r *SizeLimitRotateRule) MarkRotated() {
-	r.rotatedTime = getNowDateInRFC3339Format()
+	r.rotatedTime = r.formatTimestamp(r.now())
 }
 
-func (r *SizeLimitRotateRule) OutdatedFiles() []string {
-	var pattern string
+func (r *SizeLimitRotateRule) backupPattern(compressed bool) string {
 	dir, _, ext, prefix := r.parseFilename(r.filename)
-	if r.gzip {
-		pattern = fmt.Sprintf("%s%s%s%s*%s%s", dir, string(filepath.Separator), prefix, r.delimiter, ext, gzipExt)
-	} else {
-		pattern = fmt.Sprintf("%s%s%s%s*%s", dir, string(filepath.Separator), prefix, r.delimiter, ext)
+	if compressed {
+		return fmt.Sprintf("%s%s%s%s*%s%s%s", dir, string(filepath.Separator), prefix,
+			r.qualifiedDelimiter(), ext, r.compressedExtension(), r.suffix)
+	}
+
+	return fmt.Sprintf("%s%s%s%s*%s%s", dir, string(filepath.Separator), prefix,
+		r.qualifiedDelimiter(), ext, r.suffix)
+}
+
+func (r *SizeLimitRotateRule) OutdatedFiles() []string {
+	if r.namer != nil {
+		return outdatedFilesByNamer(r.namer, r.filename, r.retentionHours(),
+			r.maxBackups, r.compressedExtension())
 	}
 
-	files, err := filepath.Glob(pattern)
+	dir, _, ext, prefix := r.parseFilename(r.filename)
+	files, err := filepath.Glob(r.backupPattern(r.gzip))
 	if err != nil {
-		fmt.Printf("failed to delete outdated log files, error: %s\n", err)
-		Errorf("failed to delete outdated log files, error: %s", err)
-		return nil
+		// keep cleaning up whatever matched, a bad pattern must not leave
+		// the outdated backups piling up forever
+		Errorf("failed to list outdated log files, error: %s", err)
 	}
 
 	sort.Strings(files)
@@ -198,28 +859,56 @@ func (r *SizeLimitRotateRule) OutdatedFiles() []string {
 	// test if too many backups
 	if r.maxBackups > 0 && len(files) > r.maxBackups {
 		for _, f := range files[:len(files)-r.maxBackups] {
+			r.debugRetention("retention: evicting %s, over %d max backups", f, r.maxBackups)
 			outdated[f] = lang.Placeholder
 		}
 		files = files[len(files)-r.maxBackups:]
 	}
 
 	// test if any too old backups
-	if r.days > 0 {
-		boundary := time.Now().Add(-time.Hour * time.Duration(hoursPerDay*r.days)).Format(rfc3339DateFormat)
-		bf := filepath.Join(dir, fmt.Sprintf("%s%s%s%s", prefix, r.delimiter, boundary, ext))
+	if hours := r.retentionHours(); hours > 0 {
+		window := r.retentionWindow()
+		if r.keepHours > 0 && hours == r.keepHours {
+			window = fmt.Sprintf("%d hours", hours)
+		}
+		boundary := r.formatTimestamp(r.now().Add(-time.Hour * time.Duration(hours)))
+		bf := filepath.Join(dir, fmt.Sprintf("%s%s%s%s", prefix, r.qualifiedDelimiter(), boundary, ext))
 		if r.gzip {
-			bf += gzipExt
+			bf += r.compressedExtension()
 		}
+		bf += r.suffix
 		for _, f := range files {
 			if f < bf {
+				r.debugRetention("retention: evicting %s, older than %s", f, window)
 				outdated[f] = lang.Placeholder
 			} else {
 				// Becase the filenames are sorted. No need to keep looping after the first ineligible item showing up.
+				r.debugRetention("retention: keeping %s and newer, within %s", f, window)
 				break
 			}
 		}
 	}
 
+	// test if the total size budget is blown, accumulating newest first
+	if r.maxTotalSize > 0 {
+		budget := int64(r.maxTotalSize) * megabyte
+		var total int64
+		for i := len(files) - 1; i >= 0; i-- {
+			if _, ok := outdated[files[i]]; ok {
+				continue
+			}
+			info, err := os.Stat(files[i])
+			if err != nil {
+				continue
+			}
+			if total += info.Size(); total > budget {
+				r.debugRetention("retention: evicting %s, over %dMB total size",
+					files[i], r.maxTotalSize)
+				outdated[files[i]] = lang.Placeholder
+			}
+		}
+	}
+
 	var result []string
 	for k := range outdated {
 		result = append(result, k)
@@ -227,211 +916,3533 @@ func (r *SizeLimitRotateRule) OutdatedFiles() []string {
 	return result
 }
 
-// NewLogger returns a RotateLogger with given filename and rule, etc.
-func NewLogger(filename string, rule RotateRule, compress bool) (*RotateLogger, error) {
-	l := &RotateLogger{
-		filename: filename,
-		channel:  make(chan []byte, bufferSize),
-		done:     make(chan lang.PlaceholderType),
-		rule:     rule,
-		compress: compress,
-	}
-	if err := l.init(); err != nil {
-		return nil, err
+// NewDailySizeLimitRotateRule returns a rotation rule that rotates at day
+// boundaries, and splits the file mid-day once maxSize MB is exceeded.
+// Backups are named by date, same-day splits carry a sequence suffix.
+func NewDailySizeLimitRotateRule(filename, delimiter string, days, maxSize, maxBackups int,
+	gzip bool) RotateRule {
+	return &DailySizeLimitRotateRule{
+		SizeLimitRotateRule: SizeLimitRotateRule{
+			DailyRotateRule: DailyRotateRule{
+				rotatedTime: getNowDate(),
+				filename:    filename,
+				delimiter:   safeDelimiter(delimiter),
+				days:        nonNegative(days, "days"),
+				gzip:        gzip,
+			},
+			maxSize:    nonNegative(maxSize, "maxSize"),
+			maxBackups: nonNegative(maxBackups, "maxBackups"),
+		},
 	}
+}
 
-	l.startWorker()
-	return l, nil
+// BackupFileName returns the backup filename on rotating, appending a
+// sequence suffix when the dated name is already taken by an earlier
+// same-day backup.
+func (r *DailySizeLimitRotateRule) BackupFileName() string {
+	return r.backupFileNameAt(r.now())
 }
 
-// Close closes l.
-func (l *RotateLogger) Close() error {
-	var err error
+func (r *DailySizeLimitRotateRule) backupFileNameAt(t time.Time) string {
+	base := r.DailyRotateRule.backupFileNameAt(t)
+	name := base
+	for seq := 1; r.backupTaken(name); seq++ {
+		name = fmt.Sprintf("%s.%d", base, seq)
+	}
 
-	l.closeOnce.Do(func() {
-		close(l.done)
-		l.waitGroup.Wait()
+	return name
+}
 
-		if err = l.fp.Sync(); err != nil {
-			return
+func (r *DailySizeLimitRotateRule) backupTaken(name string) bool {
+	for _, candidate := range []string{
+		name,
+		name + r.compressedExtension(),
+		name + r.suffix,
+		name + r.compressedExtension() + r.suffix,
+	} {
+		if _, err := os.Stat(candidate); err == nil {
+			return true
 		}
+	}
 
-		err = l.fp.Close()
-	})
-
-	return err
+	return false
 }
 
-func (l *RotateLogger) Write(data []byte) (int, error) {
-	select {
-	case l.channel <- data:
-		return len(data), nil
-	case <-l.done:
-		log.Println(string(data))
-		return 0, ErrLogFileClosed
-	}
+// MarkRotated marks the rotated day of r to be the current day.
+func (r *DailySizeLimitRotateRule) MarkRotated() {
+	r.rotatedTime = r.now().Format(dateFormat)
 }
 
-func (l *RotateLogger) getBackupFilename() string {
-	if len(l.backup) == 0 {
-		return l.rule.BackupFileName()
+// OutdatedFiles returns the files that exceeded the keeping days or the
+// backup count.
+func (r *DailySizeLimitRotateRule) OutdatedFiles() []string {
+	outdated := make(map[string]lang.PlaceholderType)
+	for _, file := range r.DailyRotateRule.OutdatedFiles() {
+		outdated[file] = lang.Placeholder
 	}
 
-	return l.backup
-}
-
-func (l *RotateLogger) init() error {
-	l.backup = l.rule.BackupFileName()
-
-	if _, err := os.Stat(l.filename); err != nil {
-		basePath := path.Dir(l.filename)
-		if _, err = os.Stat(basePath); err != nil {
-			if err = os.MkdirAll(basePath, defaultDirMode); err != nil {
-				return err
+	if r.maxBackups > 0 {
+		files, err := filepath.Glob(r.DailyRotateRule.backupPattern(r.gzip))
+		if err != nil {
+			Errorf("failed to delete outdated log files, error: %s", err)
+		} else if sort.Strings(files); len(files) > r.maxBackups {
+			for _, file := range files[:len(files)-r.maxBackups] {
+				r.debugRetention("retention: evicting %s, over %d max backups", file, r.maxBackups)
+				outdated[file] = lang.Placeholder
 			}
 		}
+	}
 
-		if l.fp, err = os.Create(l.filename); err != nil {
-			return err
-		}
-	} else if l.fp, err = os.OpenFile(l.filename, os.O_APPEND|os.O_WRONLY, defaultFileMode); err != nil {
-		return err
+	var result []string
+	for k := range outdated {
+		result = append(result, k)
 	}
+	return result
+}
 
-	fs.CloseOnExec(l.fp)
+// ShallRotate checks if the file should be rotated,
+// either on crossing the day boundary or on exceeding the size limit.
+func (r *DailySizeLimitRotateRule) ShallRotate(currentSize, writeLen int) bool {
+	return r.DailyRotateRule.ShallRotate(currentSize, writeLen) ||
+		r.SizeLimitRotateRule.ShallRotate(currentSize, writeLen)
+}
 
-	return nil
+// NewRetentionOnlyRotateRule returns a rule that never rotates the log file,
+// but still has the aged or excess backup files in its directory removed
+// periodically, by the keeping window of days and the backup count.
+func NewRetentionOnlyRotateRule(filename, delimiter string, days, maxBackups int,
+	gzip bool) RotateRule {
+	return &RetentionOnlyRotateRule{
+		SizeLimitRotateRule: SizeLimitRotateRule{
+			DailyRotateRule: DailyRotateRule{
+				rotatedTime: getNowDateInRFC3339Format(),
+				filename:    filename,
+				delimiter:   safeDelimiter(delimiter),
+				days:        nonNegative(days, "days"),
+				gzip:        gzip,
+			},
+			maxBackups: nonNegative(maxBackups, "maxBackups"),
+		},
+	}
 }
 
-func (l *RotateLogger) maybeCompressFile(file string) {
-	if !l.compress {
-		return
+// ShallRotate always reports false, r never rotates.
+func (r *RetentionOnlyRotateRule) ShallRotate(_, _ int) bool {
+	return false
+}
+
+// NewHourlyRotateRule returns a rotation rule that rotates the log files hourly.
+// The keeping window of days still applies to the retention of backups.
+func NewHourlyRotateRule(filename, delimiter string, days int, gzip bool) RotateRule {
+	return &HourlyRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowHour(),
+			filename:    filename,
+			delimiter:   safeDelimiter(delimiter),
+			days:        nonNegative(days, "days"),
+			gzip:        gzip,
+		},
 	}
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			ErrorStack(r)
-		}
-	}()
+// BackupFileName returns the backup filename on rotating.
+func (r *HourlyRotateRule) BackupFileName() string {
+	return r.backupFileNameAt(r.now())
+}
 
-	if _, err := os.Stat(file); err != nil {
-		// file not exists or other error, ignore compression
-		return
+func (r *HourlyRotateRule) backupFileNameAt(t time.Time) string {
+	if r.namer != nil {
+		return r.namer.Name(r.filename, t, 0)
 	}
 
-	compressLogFile(file)
+	return fmt.Sprintf("%s%s%s", r.filename, r.qualifiedDelimiter(), t.Format(hourFormat))
+}
+
+// MarkRotated marks the rotated hour of r to be the current hour.
+func (r *HourlyRotateRule) MarkRotated() {
+	r.rotatedTime = r.now().Format(hourFormat)
+}
+
+// OutdatedFiles returns the files that exceeded the keeping days,
+// with the boundary computed in hours.
+func (r *HourlyRotateRule) OutdatedFiles() []string {
+	keep := r.retention()
+	if keep <= 0 {
+		return nil
+	}
+
+	if r.namer != nil {
+		return outdatedFilesByNamer(r.namer, r.filename, int(keep/time.Hour), 0,
+			r.compressedExtension())
+	}
+
+	files, err := filepath.Glob(r.backupPattern(r.gzip))
+	if err != nil {
+		Errorf("failed to delete outdated log files, error: %s", err)
+		return nil
+	}
+
+	var buf strings.Builder
+	boundary := r.now().Add(-keep).Format(hourFormat)
+	fmt.Fprintf(&buf, "%s%s%s", r.filename, r.qualifiedDelimiter(), boundary)
+	if r.gzip {
+		buf.WriteString(r.compressedExtension())
+	}
+	buf.WriteString(r.suffix)
+	boundaryFile := buf.String()
+
+	window := r.retentionWindow()
+	var outdates []string
+	for _, file := range files {
+		if file < boundaryFile {
+			r.debugRetention("retention: evicting %s, older than %s", file, window)
+			outdates = append(outdates, file)
+		} else {
+			r.debugRetention("retention: keeping %s, within %s", file, window)
+		}
+	}
+
+	return outdates
+}
+
+// ShallRotate checks if the file should be rotated.
+func (r *HourlyRotateRule) ShallRotate(_, _ int) bool {
+	return len(r.rotatedTime) > 0 && r.now().Format(hourFormat) != r.rotatedTime
+}
+
+// NewMonthlyRotateRule returns a rotation rule that rotates the log files monthly.
+// The keeping window of days still applies to the retention of backups.
+func NewMonthlyRotateRule(filename, delimiter string, days int, gzip bool) RotateRule {
+	return &MonthlyRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowMonth(),
+			filename:    filename,
+			delimiter:   safeDelimiter(delimiter),
+			days:        nonNegative(days, "days"),
+			gzip:        gzip,
+		},
+	}
+}
+
+// SetKeepMonths retains the backups of the most recent months instead of
+// counting retention in days, matching compliance setups that bucket audit
+// logs by calendar month.
+func (r *MonthlyRotateRule) SetKeepMonths(months int) {
+	r.keepMonths = nonNegative(months, "keepMonths")
+}
+
+// BackupFileName returns the backup filename on rotating.
+func (r *MonthlyRotateRule) BackupFileName() string {
+	return r.backupFileNameAt(r.now())
+}
+
+func (r *MonthlyRotateRule) backupFileNameAt(t time.Time) string {
+	if r.namer != nil {
+		return r.namer.Name(r.filename, t, 0)
+	}
+
+	return fmt.Sprintf("%s%s%s", r.filename, r.qualifiedDelimiter(), t.Format(monthFormat))
+}
+
+// MarkRotated marks the rotated month of r to be the current month.
+func (r *MonthlyRotateRule) MarkRotated() {
+	r.rotatedTime = r.now().Format(monthFormat)
+}
+
+// OutdatedFiles returns the files that exceeded the keeping months or days.
+func (r *MonthlyRotateRule) OutdatedFiles() []string {
+	keep := r.retention()
+	if keep <= 0 && r.keepMonths <= 0 {
+		return nil
+	}
+
+	if r.namer != nil {
+		return outdatedFilesByNamer(r.namer, r.filename, int(keep/time.Hour), 0,
+			r.compressedExtension())
+	}
+
+	files, err := filepath.Glob(r.backupPattern(r.gzip))
+	if err != nil {
+		Errorf("failed to delete outdated log files, error: %s", err)
+		return nil
+	}
+
+	var buf strings.Builder
+	boundary := r.now().Add(-keep).Format(monthFormat)
+	if r.keepMonths > 0 {
+		// AddDate walks the calendar backwards, so 31-day and 28-day months
+		// both count as exactly one month
+		boundary = r.now().AddDate(0, -r.keepMonths, 0).Format(monthFormat)
+	}
+	fmt.Fprintf(&buf, "%s%s%s", r.filename, r.qualifiedDelimiter(), boundary)
+	if r.gzip {
+		buf.WriteString(r.compressedExtension())
+	}
+	buf.WriteString(r.suffix)
+	boundaryFile := buf.String()
+
+	window := r.retentionWindow()
+	if r.keepMonths > 0 {
+		window = fmt.Sprintf("%d months", r.keepMonths)
+	}
+
+	var outdates []string
+	for _, file := range files {
+		if file < boundaryFile {
+			r.debugRetention("retention: evicting %s, older than %s", file, window)
+			outdates = append(outdates, file)
+		} else {
+			r.debugRetention("retention: keeping %s, within %s", file, window)
+		}
+	}
+
+	return outdates
+}
+
+// ShallRotate checks if the file should be rotated.
+func (r *MonthlyRotateRule) ShallRotate(_, _ int) bool {
+	return len(r.rotatedTime) > 0 && r.now().Format(monthFormat) != r.rotatedTime
+}
+
+// NewWeeklyRotateRule returns a rotation rule that rotates the log files
+// at ISO week boundaries. The keeping window of days still applies to the
+// retention of backups.
+func NewWeeklyRotateRule(filename, delimiter string, days int, gzip bool) RotateRule {
+	return &WeeklyRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowWeek(),
+			filename:    filename,
+			delimiter:   safeDelimiter(delimiter),
+			days:        nonNegative(days, "days"),
+			gzip:        gzip,
+		},
+	}
+}
+
+// BackupFileName returns the backup filename on rotating.
+func (r *WeeklyRotateRule) BackupFileName() string {
+	return r.backupFileNameAt(r.now())
+}
+
+func (r *WeeklyRotateRule) backupFileNameAt(t time.Time) string {
+	if r.namer != nil {
+		return r.namer.Name(r.filename, t, 0)
+	}
+
+	return fmt.Sprintf("%s%s%s", r.filename, r.qualifiedDelimiter(), formatWeek(t))
+}
+
+// MarkRotated marks the rotated week of r to be the current week.
+func (r *WeeklyRotateRule) MarkRotated() {
+	r.rotatedTime = formatWeek(r.now())
+}
+
+// OutdatedFiles returns the files that exceeded the keeping days.
+func (r *WeeklyRotateRule) OutdatedFiles() []string {
+	keep := r.retention()
+	if keep <= 0 {
+		return nil
+	}
+
+	if r.namer != nil {
+		return outdatedFilesByNamer(r.namer, r.filename, int(keep/time.Hour), 0,
+			r.compressedExtension())
+	}
+
+	files, err := filepath.Glob(r.backupPattern(r.gzip))
+	if err != nil {
+		Errorf("failed to delete outdated log files, error: %s", err)
+		return nil
+	}
+
+	var buf strings.Builder
+	boundary := formatWeek(r.now().Add(-keep))
+	fmt.Fprintf(&buf, "%s%s%s", r.filename, r.qualifiedDelimiter(), boundary)
+	if r.gzip {
+		buf.WriteString(r.compressedExtension())
+	}
+	buf.WriteString(r.suffix)
+	boundaryFile := buf.String()
+
+	window := r.retentionWindow()
+	var outdates []string
+	for _, file := range files {
+		if file < boundaryFile {
+			r.debugRetention("retention: evicting %s, older than %s", file, window)
+			outdates = append(outdates, file)
+		} else {
+			r.debugRetention("retention: keeping %s, within %s", file, window)
+		}
+	}
+
+	return outdates
+}
+
+// ShallRotate checks if the file should be rotated.
+func (r *WeeklyRotateRule) ShallRotate(_, _ int) bool {
+	return len(r.rotatedTime) > 0 && formatWeek(r.now()) != r.rotatedTime
+}
+
+// NewCronRotateRule returns a rotation rule driven by the given cron spec,
+// in the standard five fields: minute, hour, day of month, month and day of
+// week, supporting lists, ranges and steps. The rule fires once the next
+// scheduled wall-clock time has passed since the last rotation. The schedule
+// is evaluated on the local clock via the injectable timeNow, so it follows
+// DST transitions. The keeping window of days and the backup count still
+// apply to the retention of backups.
+func NewCronRotateRule(filename, delimiter, spec string, days, maxBackups int,
+	gzip bool) (RotateRule, error) {
+	schedule, err := parseCronSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CronRotateRule{
+		SizeLimitRotateRule: SizeLimitRotateRule{
+			DailyRotateRule: DailyRotateRule{
+				rotatedTime: getNowDateInRFC3339Format(),
+				filename:    filename,
+				delimiter:   safeDelimiter(delimiter),
+				days:        nonNegative(days, "days"),
+				gzip:        gzip,
+			},
+			maxBackups: nonNegative(maxBackups, "maxBackups"),
+		},
+		schedule: schedule,
+		next:     schedule.next(timeNow()),
+	}, nil
+}
+
+// MarkRotated marks the rotated time of r to be the current time,
+// and schedules the next cron boundary.
+func (r *CronRotateRule) MarkRotated() {
+	r.SizeLimitRotateRule.MarkRotated()
+	r.next = r.schedule.next(timeNow())
+}
+
+// ShallRotate checks if the next scheduled time has passed.
+func (r *CronRotateRule) ShallRotate(_, _ int) bool {
+	return !r.next.IsZero() && !timeNow().Before(r.next)
+}
+
+// NewPeriodicSizeLimitRotateRule returns a rotation rule that rotates at every
+// granularity boundary (e.g. time.Hour), and mid-period once maxSize MB is exceeded.
+func NewPeriodicSizeLimitRotateRule(filename, delimiter string, days, maxSize, maxBackups int,
+	granularity time.Duration, gzip bool) RotateRule {
+	return &PeriodicSizeLimitRotateRule{
+		SizeLimitRotateRule: SizeLimitRotateRule{
+			DailyRotateRule: DailyRotateRule{
+				rotatedTime: getNowDateInRFC3339Format(),
+				filename:    filename,
+				delimiter:   safeDelimiter(delimiter),
+				days:        nonNegative(days, "days"),
+				gzip:        gzip,
+			},
+			maxSize:    nonNegative(maxSize, "maxSize"),
+			maxBackups: nonNegative(maxBackups, "maxBackups"),
+		},
+		granularity: granularity,
+		periodStart: timeNow().Truncate(granularity),
+	}
+}
+
+// MarkRotated marks the rotated time of r to be the current time,
+// and restarts the current period.
+func (r *PeriodicSizeLimitRotateRule) MarkRotated() {
+	r.SizeLimitRotateRule.MarkRotated()
+	r.periodStart = timeNow().Truncate(r.granularity)
+}
+
+// ShallRotate checks if the file should be rotated,
+// either on crossing a granularity boundary or on exceeding the size limit.
+func (r *PeriodicSizeLimitRotateRule) ShallRotate(currentSize, writeLen int) bool {
+	if !timeNow().Truncate(r.granularity).Equal(r.periodStart) {
+		return true
+	}
+
+	return r.SizeLimitRotateRule.ShallRotate(currentSize, writeLen)
+}
+
+// NewLogger returns a RotateLogger with given filename and rule, etc.
+func NewLogger(filename string, rule RotateRule, compress bool, opts ...RotateLoggerOption) (*RotateLogger, error) {
+	if len(filename) == 0 {
+		return nil, ErrLogPathNotSet
+	}
+	// fail fast instead of panicking on the first rule call inside init
+	if rule == nil {
+		return nil, ErrNilRotateRule
+	}
+	// a rule built for another filename names and globs backups for a base
+	// the logger never writes, a common copy-paste bug, so reject it upfront
+	if err := checkRuleFilename(rule, filename); err != nil {
+		return nil, err
+	}
+
+	l := &RotateLogger{
+		filename:       filename,
+		capture:        make(chan chan captureResult),
+		forced:         make(chan chan error),
+		reconf:         make(chan reconfigRequest),
+		done:           make(chan lang.PlaceholderType),
+		rule:           rule,
+		compress:       compress,
+		compressLevel:  gzip.DefaultCompression,
+		copyBufferSize: defaultCopyBufferSize,
+		bufSize:        bufferSize,
+		inFlight:       make(map[string]lang.PlaceholderType),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.bufSize <= 0 {
+		l.bufSize = bufferSize
+	}
+	l.channel = make(chan []byte, l.bufSize)
+	if len(l.encryptionKey) > 0 {
+		if suffixed, ok := rule.(interface{ SetBackupSuffix(string) }); ok {
+			suffixed.SetBackupSuffix(encExt)
+		}
+	}
+	if l.compressor != nil {
+		if exted, ok := rule.(interface{ SetCompressedExt(string) }); ok {
+			exted.SetCompressedExt(l.compressor.Extension())
+		}
+	}
+	l.copyBufferPool.New = func() interface{} {
+		return make([]byte, l.copyBufferSize)
+	}
+	if err := l.init(); err != nil {
+		if l.lazyRetry <= 0 {
+			return nil, err
+		}
+		// defer the open error to the worker, buffering writes until it succeeds
+		Errorf("failed to open log file: %s, retrying every %s, error: %s",
+			filename, l.lazyRetry, err)
+	}
+
+	l.startWorker()
+	if l.compress && l.compressExisting {
+		l.compressLegacyBackups()
+	}
+
+	return l, nil
+}
+
+// WithAdaptiveSampling customizes a RotateLogger to switch to sampling mode
+// after the write channel is observed full on threshold consecutive writes,
+// dropping half of the lines (counted in the dropped stat) to relieve the
+// pressure on the callers, and to return to full fidelity once the channel
+// drains. It keeps request latency bounded during log storms.
+func WithAdaptiveSampling(threshold int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.sampleThreshold = threshold
+	}
+}
+
+// WithBackgroundConcurrency customizes a RotateLogger to run at most n
+// background post-rotate jobs (compressions and outdated file deletions)
+// at the same time, preventing IO saturation during bursty rotations.
+func WithBackgroundConcurrency(n int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		if n > 0 {
+			l.bgWorkers = make(chan lang.PlaceholderType, n)
+		}
+	}
+}
+
+// WithCleanupInterval customizes how often a RotateLogger sweeps outdated
+// backups independently of rotations, so a service that keeps restarting
+// before ever crossing a rotation boundary still gets its old backups cleaned
+// up. The default is once per hour, the ticker stops on Close.
+func WithCleanupInterval(interval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.cleanupInterval = interval
+	}
+}
+
+// WithRotateCheckInterval customizes a RotateLogger to check the rotation rule
+// on a timer, so a file rotates when its boundary passes even if no write
+// arrives. Without it rotation only happens on the first write after the
+// boundary, and a fully idle service never rotates at all. Zero (the default)
+// keeps rotation purely write-driven.
+func WithRotateCheckInterval(interval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.rotateCheckInterval = interval
+	}
+}
+
+// WithCloseSummary customizes a RotateLogger to log a one-line summary of its
+// lifetime counters (lines, bytes, rotations, compressions, deletions, dropped)
+// when it's closed.
+func WithCloseSummary() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.closeSummary = true
+	}
+}
+
+// WithManifest customizes a RotateLogger to append a JSON record for every
+// rotation to a <filename>.manifest file. With chained set, each record
+// carries a hash chained from the previous one, so missing or altered
+// rotation records are detectable via VerifyManifest.
+func WithManifest(chained bool) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.manifest = true
+		l.manifestChained = chained
+	}
+}
+
+// WithMarkerOnRotate customizes a RotateLogger to write an in-band marker as
+// the first line of each freshly rotated file, so downstream parsers see the
+// rotation boundary in the stream itself instead of having to correlate file
+// names. The marker follows the process-wide encoding, json by default.
+func WithMarkerOnRotate() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.rotationMarker = true
+	}
+}
+
+// WithSynchronousWrites customizes a RotateLogger to write each line to disk
+// before Write returns, bypassing the channel and the worker: the write and
+// an fsync run inline under a lock, with rotation checked on the spot. Meant
+// for low-volume audit logs that must survive a process kill; every line
+// costs a disk round trip and writers serialize on the lock, so throughput
+// drops by orders of magnitude compared to the buffered default.
+func WithSynchronousWrites() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.synchronous = true
+	}
+}
+
+// WithTailRepair customizes a RotateLogger to repair the tail of an existing
+// json-encoded file on open: a crash mid-write may leave a partial last line
+// that downstream parsers choke on, so a complete record missing its newline
+// is terminated and an unparsable fragment is truncated away before appends
+// resume.
+func WithTailRepair() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.repairOnOpen = true
+	}
+}
+
+// WithEncryption customizes a RotateLogger to encrypt every rotated backup
+// at rest with AES-GCM under key, 16, 24 or 32 bytes long for AES-128, 192
+// or 256. Compression, when enabled, runs first, so backups end in .enc or
+// .gz.enc, and the retention recognizes both. The plain file is removed only
+// after the encrypted one is fully synced to disk. DecryptLogFile reads the
+// backups back.
+func WithEncryption(key []byte) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.encryptionKey = key
+	}
+}
+
+// WithExtraOpenFlags customizes a RotateLogger to OR the given flags into
+// every open of the active log file, e.g. os.O_SYNC to trade throughput for
+// durability at the fd level. The access mode bits are stripped from flags,
+// so the append and write semantics required by the logger always remain.
+func WithExtraOpenFlags(flags int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.extraFlags = flags &^ (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	}
+}
+
+// WithFileTrailer customizes a RotateLogger to write the bytes returned by
+// trailer at the end of every sealed file, just before rotation renames it,
+// and at the end of the active file on Close. A sealed backup not ending
+// with the trailer indicates it was truncated.
+func WithFileTrailer(trailer func() []byte) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.trailer = trailer
+	}
+}
+
+// WithCompressLevel customizes the gzip compression level used on rotated
+// backups, e.g. gzip.BestSpeed for CPU-constrained edge nodes or
+// gzip.BestCompression for archival boxes. A level outside the legal gzip
+// range falls back to gzip.DefaultCompression with a logged warning.
+func WithCompressLevel(level int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			Errorf("invalid gzip compression level %d, fallback to default", level)
+			level = gzip.DefaultCompression
+		}
+		l.compressLevel = level
+	}
+}
+
+// WithCompressIORate customizes a RotateLogger to cap the read rate of the
+// built-in compression at bytesPerSec, smoothing the IO impact of compressing
+// large backups on shared disks. Zero or negative means no limit.
+func WithCompressIORate(bytesPerSec int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressIORate = bytesPerSec
+	}
+}
+
+// WithCompressSkipRatio customizes a RotateLogger to sample the head of every
+// backup before compressing it, and to keep the file plain when the sampled
+// compressed/original ratio is ratio or worse. Logs embedding base64 or
+// already compressed blobs then don't waste CPU on re-compression that can
+// even grow the file. Zero disables the heuristic.
+func WithCompressSkipRatio(ratio float64) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressSkipRatio = ratio
+	}
+}
+
+// WithKeepUncompressed customizes a RotateLogger to keep the n most recent
+// backups uncompressed, so the immediately-previous log stays easy to tail
+// and grep while the older backups still earn the disk savings. Zero
+// compresses every backup right after rotation.
+func WithKeepUncompressed(n int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressAfter = nonNegative(n, "compressAfter")
+	}
+}
+
+// WithLegacyCompression customizes a RotateLogger to compress, in the
+// background on startup, the uncompressed backups left behind from before
+// compression was enabled. Without it those backups are never matched by the
+// gzip-mode retention and pile up forever. It's opt-in to avoid a surprise
+// CPU spike on deployments with many legacy backups.
+func WithLegacyCompression() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressExisting = true
+	}
+}
+
+// WithCompressOnClose customizes a RotateLogger to seal the active file into
+// a backup and compress it synchronously on Close. Without it, short-lived
+// jobs that never crossed a rotation boundary leave their final file
+// uncompressed.
+func WithCompressOnClose() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressOnClose = true
+	}
+}
+
+// WithCompressor customizes a RotateLogger to compress rotated backups with
+// the given codec instead of the built-in gzip, e.g. a zstd implementation
+// registered by the caller. The extension of the codec is also used on
+// matching backups for retention, so cleanup stays correct for non-gzip
+// archives.
+func WithCompressor(compressor Compressor) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressor = compressor
+	}
+}
+
+// WithCompressorSelector customizes a RotateLogger to pick the compression
+// codec per backup file based on its size, e.g. fast gzip for small files
+// and a registered zstd codec for large ones. Returning a nil Compressor
+// falls back to the built-in gzip compression. Non-gzip extensions are
+// still matched by the age based retention through the uncompressed pattern.
+func WithCompressorSelector(selector func(size int64) Compressor) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressorSelector = selector
+	}
+}
+
+// WithCompressConflictPolicy customizes what a RotateLogger does when the
+// compression target of a backup already exists. The default picks a unique
+// name for the new archive, so a prior valid archive is never clobbered.
+func WithCompressConflictPolicy(policy CompressConflictPolicy) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.compressConflict = policy
+	}
+}
+
+// WithLazyRetry customizes a RotateLogger to succeed on construction even if
+// the log file cannot be opened yet, buffering writes in memory (bounded)
+// and retrying the open on the given interval until it succeeds.
+func WithLazyRetry(interval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.lazyRetry = interval
+	}
+}
+
+// WithMaxBackupStreams customizes a RotateLogger to keep at most n backup
+// files open at the same time in WriteBackupTo, queueing further requests
+// until a slot frees up. Services exposing log-download endpoints then
+// cannot exhaust the file descriptor budget under load.
+func WithMaxBackupStreams(n int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		if n > 0 {
+			l.streamSem = make(chan lang.PlaceholderType, n)
+		}
+	}
+}
+
+// WithBatchSize customizes a RotateLogger to coalesce the queued messages
+// into single underlying writes of up to size bytes, turning the syscall per
+// log line into one per batch for very chatty services. A partial batch waits
+// for more messages until the BatchFlush interval elapses, and the rotation
+// checks see the combined batch length. Zero disables batching.
+func WithBatchSize(size int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.batchSize = nonNegative(size, "batchSize")
+	}
+}
+
+// WithBatchFlush customizes how long a partial batch may wait for more
+// messages before it's written out. It only matters together with
+// WithBatchSize, and defaults to defaultBatchFlush.
+func WithBatchFlush(interval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.batchFlush = interval
+	}
+}
+
+// WithMemoryBuffer customizes a RotateLogger to accumulate writes in an
+// in-memory buffer that is flushed through the rotation-aware write path
+// when it reaches size bytes or every flushInterval, whichever comes first.
+// The remaining buffer is flushed on Close.
+func WithMemoryBuffer(size int, flushInterval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.memBufSize = size
+		l.memFlushInterval = flushInterval
+	}
+}
+
+// WithPruneEmptyBackups customizes a RotateLogger to remove zero-byte backup
+// files on the retention pass, regardless of their age or the backup count.
+func WithPruneEmptyBackups() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.pruneEmptyBackups = true
+	}
+}
+
+// WithCopyTruncate customizes a RotateLogger to rotate by copying the current
+// contents to the backup file and truncating the log file in place, keeping
+// the same open fd. It cooperates with external rotation tooling like the
+// system logrotate in copytruncate mode, which would otherwise rename the file
+// out from under the held fd. Lines written between the copy and the truncate
+// may be lost, the same tradeoff logrotate documents for copytruncate.
+func WithCopyTruncate() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.copyTruncate = true
+	}
+}
+
+// WithBufferSize customizes a RotateLogger to buffer up to size pending
+// writes before Write blocks, default 100. A larger buffer absorbs bursts
+// without backpressure on the callers, trading memory and more lines lost
+// if the process dies before the worker drains it.
+func WithBufferSize(size int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.bufSize = size
+	}
+}
+
+// WithDiscardOnClosed customizes a RotateLogger to silently discard writes
+// arriving after Close began, instead of echoing them to the standard logger.
+// Chatty services shutting down otherwise flood stderr with the rejected
+// lines. The rejected writes still fail with ErrLogFileClosed and count as
+// dropped in the stats.
+func WithDiscardOnClosed() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.discardOnClosed = true
+	}
+}
+
+// WithDropOnFull customizes a RotateLogger to drop a write instead of
+// blocking when the channel is full, preferring hot path latency over log
+// completeness under extreme load. Dropped lines only show up in the dropped
+// stat; the default keeps the blocking behavior, losing nothing.
+func WithDropOnFull() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.dropOnFull = true
+	}
+}
+
+// WithFileMode customizes the permission of the files a RotateLogger creates,
+// e.g. 0o640 for group-readable logs. Zero keeps the defaults.
+func WithFileMode(mode os.FileMode) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.fileMode = mode
+	}
+}
+
+// WithDirMode customizes the permission of the log directories a RotateLogger
+// creates. Zero keeps the default of 0o755.
+func WithDirMode(mode os.FileMode) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.dirMode = mode
+	}
+}
+
+// WithFlushInterval customizes a RotateLogger to fsync the log file every
+// interval, bounding how many seconds of acknowledged writes a crash can
+// lose from the OS page cache, e.g. for audit style logs. Sync errors are
+// logged and the worker keeps going.
+func WithFlushInterval(interval time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.flushInterval = interval
+	}
+}
+
+// WithCurrentSymlink customizes a RotateLogger to maintain a .current symlink
+// next to the log file, updated after every rotation to point at the newest
+// backup, i.e. its compressed or encrypted form once those steps ran. Tailing
+// tools and log shippers get a fixed path to the latest sealed backup without
+// resolving the timestamped names. On filesystems without symlink support the
+// logger keeps rotating and warns once.
+func WithCurrentSymlink() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.symlinkCurrent = true
+	}
+}
+
+// WithTrashRetention customizes a RotateLogger to move outdated backup files
+// into a .trash subdirectory next to the log file instead of removing them,
+// each with a tombstone recording when it was trashed, and to hard-delete
+// them only once grace has elapsed. It gives an undo window after a
+// misconfigured retention: restoring is moving the file back out of .trash.
+func WithTrashRetention(grace time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.trashGrace = grace
+	}
+}
+
+// WithOnRotate customizes a RotateLogger to invoke callback once a rotation
+// and its post-rotate work (compression, cleanup) have finished, e.g. to ship
+// the sealed backup to object storage without polling the directory. oldFile
+// is the active log file that was rotated out, newFile the final backup path,
+// i.e. the .gz path when compression is enabled. The ordering is part of the
+// contract: the callback never fires before the compression and the retention
+// sweep of the rotation completed, so tests and upload pipelines can
+// synchronize on it instead of polling or sleeping. The callback runs on the
+// background post-rotate goroutine, so it must not block indefinitely, or
+// the post-rotate work of further rotations piles up behind it.
+func WithOnRotate(callback func(oldFile, newFile string)) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.onRotate = callback
+	}
+}
+
+// WithOnError customizes a RotateLogger to deliver rotation failures to
+// callback, wrapped in *RotateError with the file involved. It lets services
+// increment metrics or page when rotation repeatedly fails, instead of the
+// failures staying buried in the process log. The callback runs on the worker
+// goroutine, so it must not block.
+func WithOnError(callback func(err error)) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.onError = callback
+	}
+}
+
+// WithOnDelete customizes a RotateLogger to deliver every retention deletion
+// to callback with the size the backup had, feeding e.g. capacity-planning
+// metrics without scraping log lines. A failed removal is delivered with a
+// non-nil err and the file still on disk. Files moved to the trash directory
+// first report once the sweep hard-deletes them after the grace period. The
+// callback runs on the goroutine doing the cleanup, so it must not block.
+func WithOnDelete(callback func(file string, size int64, err error)) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.onDelete = callback
+	}
+}
+
+// WithExclusiveLock customizes a RotateLogger to take a non-blocking advisory
+// flock on the log file when opening it, failing with ErrExclusiveLock when
+// another process already holds the file. It guards against two instances
+// accidentally appending to one filename and rotating against each other.
+// The lock is advisory: platforms and filesystems without flock support,
+// e.g. Windows and some NFS mounts, silently degrade to unlocked behavior.
+func WithExclusiveLock() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.exclusive = true
+	}
+}
+
+// WithOverlapDetection customizes a RotateLogger to claim a pid marker file
+// next to the log file on open. If a live process already holds the marker,
+// e.g. the previous pod during a rolling restart, construction waits up to
+// timeout for it to let go, then fails with ErrActiveWriter instead of
+// silently interleaving appends with the other writer.
+func WithOverlapDetection(timeout time.Duration) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.overlapTimeout = timeout
+	}
+}
+
+// WithRotateGuard customizes a RotateLogger to consult guard before every
+// rotation. Returning false defers the rotation, the triggering write still
+// goes to the current file, and the guard is re-checked on the next write.
+// It lets callers keep the file stable during e.g. an active transaction window.
+func WithRotateGuard(guard func() bool) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.rotateGuard = guard
+	}
+}
+
+// WithRotateTriggerFile customizes a RotateLogger to watch for the given
+// sentinel file, rotating and removing it once present. It serves as a
+// filesystem based alternative to signals for requesting a rotation.
+func WithRotateTriggerFile(file string) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.triggerFile = file
+	}
+}
+
+// WithStreamingGzip customizes a RotateLogger to write the active log file
+// gzip-compressed, flushing the gzip stream after each write so that
+// streaming consumers can decompress complete lines from the growing file.
+// The compression ratio is worse than post-rotation compression.
+func WithStreamingGzip() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.streamGzip = true
+	}
+}
+
+// WithRecordSeparator customizes a RotateLogger to append sep after every
+// record that does not already end with it, so records stay individually
+// framed across rotations. Formats that don't use newline framing, e.g.
+// length-prefixed binary frames, set the separator that suits them. The
+// plain and json encodings already newline-terminate their records, so
+// they need no separator.
+func WithRecordSeparator(sep []byte) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.recordSep = sep
+	}
+}
+
+// WithRecreateOnMissing customizes a RotateLogger to periodically check whether
+// the log file still exists on disk, and recreate it if it was removed.
+// Without it, writes after an external remove go into an unlinked inode
+// until the next rotation.
+func WithRecreateOnMissing() RotateLoggerOption {
+	return func(l *RotateLogger) {
+		l.recreateOnMissing = true
+	}
+}
+
+// WithCopyBufferSize customizes the size of the copy buffers used on compressing log files.
+func WithCopyBufferSize(size int) RotateLoggerOption {
+	return func(l *RotateLogger) {
+		if size > 0 {
+			l.copyBufferSize = size
+		}
+	}
+}
+
+// Close closes l.
+func (l *RotateLogger) Close() error {
+	return l.CloseCtx(context.Background())
+}
+
+// CloseCtx closes l like Close, but gives up waiting for the worker to drain
+// once ctx is done, returning ctx.Err() and leaving the file to be closed
+// best-effort. It bounds shutdown time when the worker is stuck on a bad disk.
+func (l *RotateLogger) CloseCtx(ctx context.Context) error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		defer l.releaseWriterMarker()
+
+		atomic.StoreInt32(&l.closing, 1)
+		close(l.done)
+
+		drained := make(chan lang.PlaceholderType)
+		go func() {
+			l.waitGroup.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+
+		if l.closeSummary {
+			Infof("rotate logger closed, %s", l.summary())
+		}
+
+		// an in-flight synchronous write finishes before the fd goes away
+		l.lockSync()
+		defer l.unlockSync()
+
+		if l.compressOnClose {
+			err = l.sealOnClose()
+			return
+		}
+
+		l.writeTrailer()
+		l.closeStream()
+		if l.fp == nil {
+			return
+		}
+
+		if err = l.fp.Sync(); err != nil {
+			return
+		}
+
+		err = l.fp.Close()
+	})
+
+	return err
+}
+
+// DiskUsage returns the total size in bytes taken up by the active log file
+// and all the backup files matched by the rotation rule,
+// counting compressed backups with their compressed sizes.
+func (l *RotateLogger) DiskUsage() (int64, error) {
+	var total int64
+	if info, err := os.Stat(l.filename); err == nil {
+		total += info.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	patterner, ok := l.getRule().(backupPatterner)
+	if !ok {
+		return total, nil
+	}
+
+	seen := make(map[string]lang.PlaceholderType)
+	for _, compressed := range []bool{false, true} {
+		files, err := filepath.Glob(patterner.backupPattern(compressed))
+		if err != nil {
+			return 0, err
+		}
+
+		for _, file := range files {
+			if _, ok := seen[file]; ok || file == l.filename {
+				continue
+			}
+
+			seen[file] = lang.Placeholder
+			if info, err := os.Stat(file); err == nil {
+				total += info.Size()
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// ImportExisting brings unmanaged legacy log files under management:
+// files in dir matching pattern are renamed to the backup naming scheme of
+// the rotation rule, timestamped with their modification times, then the
+// usual compression and retention run on them. It's meant as a one-shot
+// migration helper, called right after NewLogger and before writing.
+func (l *RotateLogger) ImportExisting(dir, pattern string) error {
+	namer, ok := l.getRule().(backupTimeNamer)
+	if !ok {
+		return ErrImportUnsupported
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file == l.filename {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		target := namer.backupFileNameAt(info.ModTime())
+		if target == file {
+			continue
+		}
+		if _, err := os.Stat(target); err == nil {
+			// pick a unique name, never clobber an existing backup
+			for i := 1; ; i++ {
+				candidate := fmt.Sprintf("%s.%d", target, i)
+				if _, err := os.Stat(candidate); os.IsNotExist(err) {
+					target = candidate
+					break
+				}
+			}
+		}
+
+		if err := os.Rename(file, target); err != nil {
+			return err
+		}
+
+		l.maybeCompressFile(target)
+		l.maybeEncryptFile(target)
+	}
+
+	l.maybeDeleteOutdatedFiles()
+	return nil
+}
+
+// WriteBackupTo streams the named backup file to w, transparently
+// decompressing gzip compressed backups. It can be used to serve rotated
+// logs over HTTP without reaching into the filesystem directly.
+func (l *RotateLogger) WriteBackupTo(name string, w io.Writer) error {
+	if l.streamSem != nil {
+		l.streamSem <- lang.Placeholder
+		defer func() {
+			<-l.streamSem
+		}()
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(name, gzipExt) {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		reader = gr
+	}
+
+	buf := l.copyBufferPool.Get().([]byte)
+	defer l.copyBufferPool.Put(buf)
+	_, err = io.CopyBuffer(w, reader, buf)
+	return err
+}
+
+// Pause temporarily disables rotation, keeping all writes in the current file.
+// While paused the file may exceed the size limits of the rule.
+func (l *RotateLogger) Pause() {
+	atomic.StoreInt32(&l.paused, 1)
+}
+
+// Resume re-enables rotation after a Pause.
+// A pending rotation check runs on the next write.
+func (l *RotateLogger) Resume() {
+	atomic.StoreInt32(&l.paused, 0)
+}
+
+// Reconfigure applies the rotation settings of conf at runtime in one shot:
+// the rotation rule built from RotationRuleType and its rule settings
+// (MaxSize, MaxBackups, RotationCronSpec, the keeping windows, UTC), plus the
+// compression of future backups. The swap runs on the worker goroutine after
+// all the accepted writes, so writes never observe a half-applied config. The
+// new rule takes effect on the next write, the compress and retention
+// settings at the next rotation; the active file is left in place. The level,
+// mode and encoding of conf are ignored.
+func (l *RotateLogger) Reconfigure(conf LogConf) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+
+	// mirror the rule construction of createOutput, so a reconfigure ends up
+	// with the same rule the config would produce at startup
+	var rule RotateRule
+	switch conf.RotationRuleType {
+	case LogRotationRuleTypeSizeLimit:
+		sized := NewSizeLimitRotateRule(l.filename, backupFileDelimiter, conf.KeepDays,
+			conf.MaxSize, conf.MaxBackups, conf.MaxTotalSize, conf.Compress).(*SizeLimitRotateRule)
+		if conf.KeepHours > 0 {
+			sized.SetKeepHours(conf.KeepHours)
+		}
+		rule = sized
+	case LogRotationRuleTypeMonthly:
+		monthly := NewMonthlyRotateRule(l.filename, backupFileDelimiter, conf.KeepDays,
+			conf.Compress).(*MonthlyRotateRule)
+		if conf.KeepMonths > 0 {
+			monthly.SetKeepMonths(conf.KeepMonths)
+		}
+		rule = monthly
+	case LogRotationRuleTypeHourly:
+		rule = NewHourlyRotateRule(l.filename, backupFileDelimiter, conf.KeepDays,
+			conf.Compress)
+	case LogRotationRuleTypeWeekly:
+		rule = NewWeeklyRotateRule(l.filename, backupFileDelimiter, conf.KeepDays,
+			conf.Compress)
+	case LogRotationRuleTypeCron:
+		var err error
+		if rule, err = NewCronRotateRule(l.filename, backupFileDelimiter,
+			conf.RotationCronSpec, conf.KeepDays, conf.MaxBackups,
+			conf.Compress); err != nil {
+			return err
+		}
+	default:
+		rule = DefaultRotateRule(l.filename, backupFileDelimiter, conf.KeepDays,
+			conf.Compress)
+	}
+
+	if conf.KeepDuration > 0 {
+		if durable, ok := rule.(interface{ SetKeepDuration(time.Duration) }); ok {
+			durable.SetKeepDuration(conf.KeepDuration)
+		}
+	}
+	if conf.UTC {
+		if zoned, ok := rule.(interface{ SetUTC(bool) }); ok {
+			zoned.SetUTC(true)
+			// re-mark so the remembered boundary is in the same zone as the
+			// later comparisons
+			rule.MarkRotated()
+		}
+	}
+
+	req := reconfigRequest{
+		rule:     rule,
+		compress: conf.Compress,
+		done:     make(chan lang.PlaceholderType),
+	}
+	select {
+	case l.reconf <- req:
+		<-req.done
+		return nil
+	case <-l.done:
+		return ErrLogFileClosed
+	}
+}
+
+// SetRule swaps the rotation rule of l at runtime, e.g. when an admin API
+// switches the service into a debug mode with a different rotation policy.
+// The swap runs on the worker goroutine after all the accepted writes, so no
+// write ever observes a half-swapped rule; future rotation checks and
+// retention use the new rule. The active file is not retroactively renamed,
+// the new naming scheme only applies from the next rotation on.
+func (l *RotateLogger) SetRule(rule RotateRule) error {
+	if rule == nil {
+		return ErrNilRotateRule
+	}
+	if err := checkRuleFilename(rule, l.filename); err != nil {
+		return err
+	}
+
+	req := reconfigRequest{
+		rule:         rule,
+		keepCompress: true,
+		done:         make(chan lang.PlaceholderType),
+	}
+	select {
+	case l.reconf <- req:
+		<-req.done
+		return nil
+	case <-l.done:
+		return ErrLogFileClosed
+	}
+}
+
+// Rotate forces a clean cut to a fresh log file on demand, regardless of the
+// size and time limits of the rule, e.g. from a SIGHUP handler or an admin
+// endpoint during incident response. The request runs on the worker goroutine
+// after all the accepted writes, never racing them.
+func (l *RotateLogger) Rotate() error {
+	req := make(chan error, 1)
+	select {
+	case l.forced <- req:
+		return <-req
+	case <-l.done:
+		return ErrLogFileClosed
+	}
+}
+
+// RotateAndCapture seals the current log file as a backup and returns its
+// contents, read before any compression, so the caller can immediately
+// re-process or display the sealed lines. The request runs on the worker
+// goroutine after all the accepted writes, never racing them.
+func (l *RotateLogger) RotateAndCapture() ([]byte, error) {
+	req := make(chan captureResult, 1)
+	select {
+	case l.capture <- req:
+		result := <-req
+		return result.data, result.err
+	case <-l.done:
+		return nil, ErrLogFileClosed
+	}
+}
+
+// Stats returns a snapshot of the recorded latency distributions of l:
+// the rotation-cycle durations and the write-path enqueue latencies,
+// each over a sliding window of the most recent samples.
+func (l *RotateLogger) Stats() RotateLoggerStats {
+	return RotateLoggerStats{
+		RotateDuration: l.rotateLatency.snapshot(),
+		WriteLatency:   l.writeLatency.snapshot(),
+	}
+}
+
+// BytesWritten returns the total bytes written to the log file over the
+// lifetime of l, safe to read while the worker goroutine keeps writing.
+func (l *RotateLogger) BytesWritten() int64 {
+	return atomic.LoadInt64(&l.stats.bytes)
+}
+
+// DroppedBytes returns the total bytes dropped because the log file could not
+// be opened, typically after a rotate failed on a full disk.
+func (l *RotateLogger) DroppedBytes() int64 {
+	return atomic.LoadInt64(&l.stats.droppedBytes)
+}
+
+// RotationCount returns how many times l has rotated its log file, letting
+// metric collectors watch the rotation frequency without instrumenting calls.
+func (l *RotateLogger) RotationCount() int64 {
+	return atomic.LoadInt64(&l.stats.rotations)
+}
+
+// PendingCount returns how many accepted writes currently sit in the write
+// channel of l. It's a point-in-time snapshot, the worker keeps draining
+// while it's read, graph it against Capacity to watch buffer utilization.
+func (l *RotateLogger) PendingCount() int {
+	return len(l.channel)
+}
+
+// Capacity returns the size of the write channel of l, the denominator for
+// the PendingCount utilization gauge.
+func (l *RotateLogger) Capacity() int {
+	return cap(l.channel)
+}
+
+// PendingDeletions returns the backup files the retention of l would delete
+// right now, without removing anything. It lets operators audit a retention
+// config in staging before enabling it.
+func (l *RotateLogger) PendingDeletions() []string {
+	return l.getRule().OutdatedFiles()
+}
+
+// Sampling returns whether l is currently sampling writes because of
+// sustained fullness of the write channel.
+func (l *RotateLogger) Sampling() bool {
+	return atomic.LoadInt32(&l.sampling) != 0
+}
+
+// Rotating returns whether l is rotating the log file,
+// or post-rotate background work (compression, cleanup) is ongoing.
+func (l *RotateLogger) Rotating() bool {
+	return atomic.LoadInt32(&l.rotating) > 0
+}
+
+// Write writes data into the log file. Once Close begins, all writes
+// deterministically fail with ErrLogFileClosed instead of racing the
+// shutdown of the worker. A rejected write returns n == 0 per the io.Writer
+// contract, none of data reaches the log file, and the line is echoed to the
+// standard logger as a last resort unless WithDiscardOnClosed is set.
+func (l *RotateLogger) Write(data []byte) (int, error) {
+	if atomic.LoadInt32(&l.closing) != 0 {
+		l.dropClosed(data)
+		return 0, ErrLogFileClosed
+	}
+
+	if l.synchronous {
+		return l.writeSynchronously(data)
+	}
+
+	if l.sampleThreshold > 0 && l.shallSample() {
+		atomic.AddInt64(&l.stats.dropped, 1)
+		return len(data), nil
+	}
+
+	start := time.Now()
+	if l.dropOnFull {
+		select {
+		case l.channel <- data:
+			l.writeLatency.record(time.Since(start))
+		default:
+			atomic.AddInt64(&l.stats.dropped, 1)
+		}
+		return len(data), nil
+	}
+
+	select {
+	case l.channel <- data:
+		l.writeLatency.record(time.Since(start))
+		return len(data), nil
+	case <-l.done:
+		l.dropClosed(data)
+		return 0, ErrLogFileClosed
+	}
+}
+
+// writeSynchronously writes data to the file inline, rotating on the spot and
+// fsyncing before returning, so the line survives a process kill right after.
+func (l *RotateLogger) writeSynchronously(data []byte) (int, error) {
+	l.syncLock.Lock()
+	defer l.syncLock.Unlock()
+
+	// re-checked under the lock, Close may have won the race and closed the fd
+	if atomic.LoadInt32(&l.closing) != 0 {
+		l.dropClosed(data)
+		return 0, ErrLogFileClosed
+	}
+
+	l.write(data)
+	if l.fp == nil {
+		// e.g. a full disk made both the rotation and the reopen fail,
+		// the line did not hit the disk
+		return 0, fmt.Errorf("log file %s is not open", l.filename)
+	}
+	if err := l.fp.Sync(); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// lockSync serializes the worker's timer-driven file work with the inline
+// writes of the synchronous mode, and is free otherwise.
+func (l *RotateLogger) lockSync() {
+	if l.synchronous {
+		l.syncLock.Lock()
+	}
+}
+
+func (l *RotateLogger) unlockSync() {
+	if l.synchronous {
+		l.syncLock.Unlock()
+	}
+}
+
+// dropClosed accounts a write rejected because the logger is closed, echoing
+// the line to the standard logger unless configured to discard it.
+func (l *RotateLogger) dropClosed(data []byte) {
+	atomic.AddInt64(&l.stats.dropped, 1)
+	if !l.discardOnClosed {
+		log.Println(string(data))
+	}
+}
+
+func (l *RotateLogger) shallSample() bool {
+	if len(l.channel) < cap(l.channel) {
+		atomic.StoreInt32(&l.consecutiveFull, 0)
+		atomic.StoreInt32(&l.sampling, 0)
+		return false
+	}
+
+	if atomic.AddInt32(&l.consecutiveFull, 1) < int32(l.sampleThreshold) {
+		return false
+	}
+
+	atomic.StoreInt32(&l.sampling, 1)
+	// keep one of every two lines, to relieve pressure without going dark
+	return atomic.AddInt64(&l.sampleCounter, 1)%2 != 0
+}
+
+// getRule returns the active rotation rule of l, consistent under a
+// concurrent Reconfigure. The worker goroutine reads l.rule directly,
+// being the only writer.
+func (l *RotateLogger) getRule() RotateRule {
+	l.ruleLock.RLock()
+	defer l.ruleLock.RUnlock()
+	return l.rule
+}
+
+// getCompress is the Reconfigure-safe counterpart of getRule for the
+// compression flag.
+func (l *RotateLogger) getCompress() bool {
+	l.ruleLock.RLock()
+	defer l.ruleLock.RUnlock()
+	return l.compress
+}
+
+func (l *RotateLogger) getBackupFilename() string {
+	if len(l.backup) == 0 {
+		return l.rule.BackupFileName()
+	}
+
+	return l.backup
+}
+
+// freshBackupFilename returns the name to rotate the current file into.
+// Rotating twice within the same timestamp granularity would rename over the
+// earlier backup, losing its logs, so an already taken name is sequenced.
+func (l *RotateLogger) freshBackupFilename() string {
+	name := l.getBackupFilename()
+	if _, err := os.Stat(name); err == nil {
+		return uniqueBackupName(name, filepath.Ext(l.filename))
+	}
+
+	return name
+}
+
+// uniqueBackupName appends the first free sequence number to name, keeping
+// the filename extension at the end when name carries it, so the glob
+// patterns of the rules still match the sequenced backups.
+func uniqueBackupName(name, ext string) string {
+	base := name
+	if len(ext) > 0 && strings.HasSuffix(name, ext) {
+		base = strings.TrimSuffix(name, ext)
+	} else {
+		ext = ""
+	}
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+func (l *RotateLogger) init() error {
+	if l.overlapTimeout > 0 && !l.markerOwned {
+		if err := l.claimWriterMarker(); err != nil {
+			return err
+		}
+	}
+
+	l.backup = l.rule.BackupFileName()
+	if l.manifestChained {
+		l.loadManifestHash()
+	}
+
+	if info, err := os.Stat(l.filename); err != nil {
+		basePath := path.Dir(l.filename)
+		if _, err = os.Stat(basePath); err != nil {
+			if err = os.MkdirAll(basePath, l.makeDirMode()); err != nil {
+				return err
+			}
+		}
+
+		if l.fp, err = l.createFile(); err != nil {
+			return err
+		}
+	} else {
+		if l.repairOnOpen {
+			if err := l.repairTruncatedTail(); err != nil {
+				Errorf("failed to repair log file %s, error: %s", l.filename, err)
+			} else if info, err = os.Stat(l.filename); err != nil {
+				return err
+			}
+		}
+
+		if l.fp, err = os.OpenFile(l.filename, os.O_APPEND|os.O_WRONLY|l.extraFlags,
+			l.makeFileMode(defaultFileMode)); err != nil {
+			return err
+		}
+		if err = l.lockExclusive(l.fp); err != nil {
+			l.fp.Close()
+			l.fp = nil
+			return err
+		}
+
+		// seed the size of the appended file, so a near-limit file rotates on
+		// the next write instead of growing far past the limit after a restart
+		l.currentSize = int(info.Size())
+	}
+
+	fs.CloseOnExec(l.fp)
+	l.setupStream()
+
+	return nil
+}
+
+// repairTruncatedTail fixes the tail of an existing json-encoded file that a
+// crash mid-write left with a partial last line: a complete record just
+// missing its newline gets the newline appended, an unparsable fragment is
+// truncated away. Plain encoding is left alone, every byte sequence is a
+// valid plain line once terminated.
+func (l *RotateLogger) repairTruncatedTail() error {
+	if atomic.LoadUint32(&encoding) != jsonEncodingType {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.filename, os.O_RDWR, l.makeFileMode(defaultFileMode))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil
+	}
+
+	probe := int64(tailProbeBytes)
+	if size < probe {
+		probe = size
+	}
+	buf := make([]byte, probe)
+	if _, err = f.ReadAt(buf, size-probe); err != nil {
+		return err
+	}
+	if buf[len(buf)-1] == '\n' {
+		return nil
+	}
+
+	if bytes.LastIndexByte(buf, '\n') < 0 && probe < size {
+		// the partial line reaches beyond the probe, read the whole file
+		probe = size
+		buf = make([]byte, probe)
+		if _, err = f.ReadAt(buf, 0); err != nil {
+			return err
+		}
+	}
+
+	tail := buf[bytes.LastIndexByte(buf, '\n')+1:]
+	if json.Valid(tail) {
+		// a complete record, the crash only lost the trailing newline
+		_, err = f.WriteAt([]byte{'\n'}, size)
+		return err
+	}
+
+	// an unparsable fragment, drop it so downstream parsers resume cleanly
+	return f.Truncate(size - int64(len(tail)))
+}
+
+func (l *RotateLogger) claimWriterMarker() error {
+	marker := l.filename + writerMarkerExt
+	deadline := timeNow().Add(l.overlapTimeout)
+
+	for {
+		f, err := os.OpenFile(marker, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFileMode)
+		if err == nil {
+			fmt.Fprint(f, os.Getpid())
+			f.Close()
+			l.markerOwned = true
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		if data, err := os.ReadFile(marker); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err != nil ||
+				!processAlive(pid) {
+				// the previous writer died without cleaning up, take over
+				os.Remove(marker)
+				continue
+			}
+		}
+
+		if !timeNow().Before(deadline) {
+			return ErrActiveWriter
+		}
+
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+func (l *RotateLogger) releaseWriterMarker() {
+	if l.markerOwned {
+		os.Remove(l.filename + writerMarkerExt)
+		l.markerOwned = false
+	}
+}
+
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	return proc.Signal(syscall.Signal(0)) == nil
+}
+
+func (l *RotateLogger) createFile() (*os.File, error) {
+	// same flags and mode as os.Create, with the user supplied extra flags
+	fp, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC|l.extraFlags,
+		l.makeFileMode(0o666))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.lockExclusive(fp); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return fp, nil
+}
+
+// lockExclusive takes the advisory lock on fp when the logger is exclusive,
+// so a second process pointed at the same filename fails instead of
+// interleaving appends and racing rotations with this one.
+func (l *RotateLogger) lockExclusive(fp *os.File) error {
+	if !l.exclusive {
+		return nil
+	}
+
+	if err := fs.TryLockFile(fp); err != nil {
+		return fmt.Errorf("%w: %s", ErrExclusiveLock, err)
+	}
+
+	return nil
+}
+
+// makeFileMode resolves the permission for a file the logger creates,
+// falling back to fallback when no mode was configured.
+func (l *RotateLogger) makeFileMode(fallback os.FileMode) os.FileMode {
+	if l.fileMode != 0 {
+		return l.fileMode
+	}
+
+	return fallback
+}
+
+func (l *RotateLogger) makeDirMode() os.FileMode {
+	if l.dirMode != 0 {
+		return l.dirMode
+	}
+
+	return defaultDirMode
+}
+
+// syncFile pushes the buffered log data through to the disk, bounding what a
+// crash can lose. Only called from the worker goroutine.
+func (l *RotateLogger) syncFile() {
+	if l.fp == nil {
+		return
+	}
+
+	if l.gzStream != nil {
+		l.gzStream.Flush()
+	}
+	if err := l.fp.Sync(); err != nil {
+		Errorf("failed to sync log file: %s, error: %s", l.filename, err)
+	}
+}
+
+func (l *RotateLogger) setupStream() {
+	if l.streamGzip && l.fp != nil {
+		l.gzStream = gzip.NewWriter(l.fp)
+	}
+}
+
+func (l *RotateLogger) closeStream() {
+	if l.gzStream != nil {
+		l.gzStream.Close()
+		l.gzStream = nil
+	}
+}
+
+func (l *RotateLogger) maybeCompressFile(file string) {
+	if !l.getCompress() {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			ErrorStack(r)
+		}
+	}()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		// file not exists or other error, ignore compression
+		return
+	}
+
+	if !l.compressionWorthwhile(file) {
+		return
+	}
+
+	if l.compressor != nil {
+		l.compressWith(l.compressor, file)
+		return
+	}
+
+	if l.compressorSelector != nil {
+		if compressor := l.compressorSelector(info.Size()); compressor != nil {
+			l.compressWith(compressor, file)
+			return
+		}
+	}
+
+	l.markInFlight(file, file+gzipExt)
+	defer l.unmarkInFlight(file, file+gzipExt)
+	buf := l.copyBufferPool.Get().([]byte)
+	defer l.copyBufferPool.Put(buf)
+	compressLogFile(file, buf, l.compressConflict, l.compressIORate, l.compressLevel)
+	atomic.AddInt64(&l.stats.compressions, 1)
+}
+
+// markInFlight registers files as being compressed right now, keeping an
+// overlapping retention sweep away from them.
+func (l *RotateLogger) markInFlight(files ...string) {
+	l.inFlightLock.Lock()
+	defer l.inFlightLock.Unlock()
+	for _, file := range files {
+		l.inFlight[file] = lang.Placeholder
+	}
+}
+
+func (l *RotateLogger) unmarkInFlight(files ...string) {
+	l.inFlightLock.Lock()
+	defer l.inFlightLock.Unlock()
+	for _, file := range files {
+		delete(l.inFlight, file)
+	}
+}
+
+func (l *RotateLogger) isInFlight(file string) bool {
+	l.inFlightLock.Lock()
+	defer l.inFlightLock.Unlock()
+	_, ok := l.inFlight[file]
+	return ok
+}
+
+func (l *RotateLogger) markLastBackup(file string) {
+	l.lastBackupLock.Lock()
+	defer l.lastBackupLock.Unlock()
+	l.lastBackup = file
+}
+
+// isLastBackup reports whether file is the most recently sealed backup, under
+// any of the names the compression and encryption steps may have given it.
+func (l *RotateLogger) isLastBackup(file string) bool {
+	l.lastBackupLock.Lock()
+	last := l.lastBackup
+	l.lastBackupLock.Unlock()
+	if len(last) == 0 {
+		return false
+	}
+
+	compressedExt := gzipExt
+	if l.compressor != nil {
+		compressedExt = l.compressor.Extension()
+	}
+	switch file {
+	case last, last + compressedExt, last + encExt, last + compressedExt + encExt:
+		return true
+	}
+
+	return false
+}
+
+// plainBackups lists the backups of l that no compression or encryption step
+// processed yet, sorted lexicographically, i.e. oldest first. ok is false
+// when the rule cannot enumerate its backups.
+func (l *RotateLogger) plainBackups() (backups []string, ok bool) {
+	patterner, ok := l.getRule().(backupPatterner)
+	if !ok {
+		return nil, false
+	}
+
+	files, err := filepath.Glob(patterner.backupPattern(false))
+	if err != nil {
+		Errorf("failed to list backup files, error: %s", err)
+		return nil, false
+	}
+
+	compressedExt := gzipExt
+	if l.compressor != nil {
+		compressedExt = l.compressor.Extension()
+	}
+
+	// the daily pattern also matches the already processed backups
+	plain := files[:0]
+	for _, file := range files {
+		if !strings.HasSuffix(file, compressedExt) && !strings.HasSuffix(file, encExt) {
+			plain = append(plain, file)
+		}
+	}
+
+	sort.Strings(plain)
+	return plain, true
+}
+
+// compressAgedBackups compresses the uncompressed backups older than the
+// compressAfter newest ones, leaving the most recent backups plain.
+func (l *RotateLogger) compressAgedBackups() {
+	plain, ok := l.plainBackups()
+	if !ok || len(plain) <= l.compressAfter {
+		return
+	}
+
+	for _, file := range plain[:len(plain)-l.compressAfter] {
+		l.maybeCompressFile(file)
+	}
+}
+
+// compressLegacyBackups reconciles backups that predate compression being
+// enabled: the gzip-mode retention glob only matches .gz files, so plain
+// backups from before the config change would otherwise never be compressed
+// or cleaned up. It runs once on startup, in the background.
+func (l *RotateLogger) compressLegacyBackups() {
+	atomic.AddInt32(&l.rotating, 1)
+	go func() {
+		defer atomic.AddInt32(&l.rotating, -1)
+
+		if l.bgWorkers != nil {
+			l.bgWorkers <- lang.Placeholder
+			defer func() {
+				<-l.bgWorkers
+			}()
+		}
+
+		l.compressAgedBackups()
+		l.maybeDeleteOutdatedFiles()
+	}()
+}
+
+func (l *RotateLogger) compressWith(compressor Compressor, file string) {
+	l.markInFlight(file, file+compressor.Extension())
+	defer l.unmarkInFlight(file, file+compressor.Extension())
+	start := time.Now()
+	Infof("compressing log file: %s", file)
+	if dst, err := compressor.Compress(file); err != nil {
+		Errorf("compress error: %s", err)
+	} else {
+		Infof("compressed log file: %s, took %s", dst, time.Since(start))
+		atomic.AddInt64(&l.stats.compressions, 1)
+	}
+}
+
+func (l *RotateLogger) compressionWorthwhile(file string) bool {
+	if l.compressSkipRatio <= 0 {
+		return true
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+
+	sample := make([]byte, compressSampleSize)
+	n, err := f.Read(sample)
+	if n == 0 || (err != nil && err != io.EOF) {
+		return true
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(sample[:n])
+	w.Close()
+
+	if ratio := float64(buf.Len()) / float64(n); ratio >= l.compressSkipRatio {
+		Infof("skipping compression of %s, sampled ratio %.2f", file, ratio)
+		return false
+	}
+
+	return true
+}
+
+func (l *RotateLogger) maybeEncryptFile(file string) {
+	if len(l.encryptionKey) == 0 {
+		return
+	}
+
+	// compression, when enabled, already renamed the file
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if l.compressor != nil {
+			file += l.compressor.Extension()
+		} else {
+			file += gzipExt
+		}
+	}
+
+	if err := encryptLogFile(file, l.encryptionKey); err != nil {
+		Errorf("failed to encrypt log file: %s, error: %s", file, err)
+	}
+}
+
+func encryptLogFile(file string, key []byte) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newLogCipher(key)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(file+encExt, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := out.Write(gcm.Seal(nonce, nonce, data, nil)); err != nil {
+		return err
+	}
+	// only remove the plain file once the encrypted one is durably on disk
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	return os.Remove(file)
+}
+
+// DecryptLogFile reads an AES-GCM encrypted backup produced under
+// WithEncryption and returns its plain contents, transparently decompressing
+// gzip compressed backups (.gz.enc).
+func DecryptLogFile(file string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newLogCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted log file too short: %s", file)
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(strings.TrimSuffix(file, encExt), gzipExt) {
+		gr, err := gzip.NewReader(bytes.NewReader(plain))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return io.ReadAll(gr)
+	}
+
+	return plain, nil
+}
+
+func newLogCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (l *RotateLogger) maybeRecreateFile() {
+	if _, err := os.Stat(l.filename); err == nil || !os.IsNotExist(err) {
+		return
+	}
+
+	l.closeStream()
+	if l.fp != nil {
+		l.fp.Close()
+		l.fp = nil
+	}
+
+	if fp, err := l.createFile(); err != nil {
+		Errorf("failed to recreate log file: %s, error: %s", l.filename, err)
+	} else {
+		fs.CloseOnExec(fp)
+		l.fp = fp
+		l.currentSize = 0
+		l.setupStream()
+	}
+}
+
+// batchOrWrite coalesces the message with whatever else already sits in the
+// write channel, flushing once the combined batch reaches the size threshold.
+// A partial batch is held for the batch flush ticker to pick up, so a quiet
+// stream still reaches the disk within the flush interval.
+func (l *RotateLogger) batchOrWrite(v []byte) {
+	l.appendBatch(v)
+	for len(l.batchBuf) < l.batchSize {
+		select {
+		case event := <-l.channel:
+			l.appendBatch(event)
+		default:
+			return
+		}
+	}
+
+	l.flushBatch()
+}
+
+// appendBatch adds one message to the batch, terminating it with the record
+// separator so the messages stay delimited inside the combined write.
+func (l *RotateLogger) appendBatch(v []byte) {
+	l.batchBuf = append(l.batchBuf, v...)
+	if len(l.recordSep) > 0 && !bytes.HasSuffix(l.batchBuf, l.recordSep) {
+		l.batchBuf = append(l.batchBuf, l.recordSep...)
+	}
+	l.batchLines++
+}
+
+// flushBatch writes the held batch through the rotation-aware write path,
+// so the rotation checks account for the combined length.
+func (l *RotateLogger) flushBatch() {
+	if len(l.batchBuf) == 0 {
+		return
+	}
+
+	l.bufferOrWrite(l.batchBuf, l.batchLines)
+	l.batchBuf = l.batchBuf[:0]
+	l.batchLines = 0
+}
+
+func (l *RotateLogger) bufferOrWrite(v []byte, lines int64) {
+	if l.memBufSize <= 0 {
+		l.writeLines(v, lines)
+		return
+	}
+
+	l.memBuf = append(l.memBuf, v...)
+	l.memBufLines += lines
+	if len(l.memBuf) >= l.memBufSize {
+		l.flushMemoryBuffer()
+	}
+}
+
+func (l *RotateLogger) flushMemoryBuffer() {
+	if len(l.memBuf) == 0 {
+		return
+	}
+
+	l.writeLines(l.memBuf, l.memBufLines)
+	l.memBuf = l.memBuf[:0]
+	l.memBufLines = 0
+}
+
+func (l *RotateLogger) bufferPending(v []byte, lines int64) {
+	if l.pendingBytes+len(v) > maxLazyPendingBytes {
+		atomic.AddInt64(&l.stats.dropped, 1)
+		return
+	}
+
+	// v may alias the reused memory or batch buffer, which the flushes
+	// truncate and refill before the replay, so queue a copy
+	buf := make([]byte, len(v))
+	copy(buf, v)
+	l.pending = append(l.pending, pendingWrite{data: buf, lines: lines})
+	l.pendingBytes += len(buf)
+}
+
+func (l *RotateLogger) maybeOpenLazily() {
+	if l.fp != nil {
+		return
+	}
+
+	if err := l.init(); err != nil {
+		return
+	}
+
+	pending := l.pending
+	l.pending = nil
+	l.pendingBytes = 0
+	for _, v := range pending {
+		l.writeLines(v.data, v.lines)
+	}
+}
+
+func (l *RotateLogger) maybeRotateOnTrigger() {
+	if _, err := os.Stat(l.triggerFile); err != nil {
+		return
+	}
+
+	if err := l.rotate(); err != nil {
+		log.Println(err)
+		l.reportError(err)
+	} else {
+		l.rule.MarkRotated()
+		l.currentSize = 0
+	}
+
+	if err := os.Remove(l.triggerFile); err != nil {
+		Errorf("failed to remove rotate trigger file: %s, error: %s", l.triggerFile, err)
+	}
 }
 
 func (l *RotateLogger) maybeDeleteOutdatedFiles() {
-	files := l.rule.OutdatedFiles()
+	if l.pruneEmptyBackups {
+		l.pruneEmptyBackupFiles()
+	}
+
+	rule := l.getRule()
+	var debug bool
+	if debugger, ok := rule.(interface{ retentionDebug() bool }); ok {
+		debug = debugger.retentionDebug()
+	}
+
+	files := rule.OutdatedFiles()
+	if debug && len(files) > 0 {
+		Infof("retention: %d outdated files pending deletion: %v", len(files), files)
+	}
+	for _, file := range files {
+		if l.isLastBackup(file) {
+			// the backup this rotation just sealed, deleting it would throw
+			// away the content we just preserved, e.g. when maxBackups is 1
+			// and a stray future-named backup sorts newer
+			if debug {
+				Infof("retention: skipping %s, just rotated", file)
+			}
+			continue
+		}
+
+		if l.isInFlight(file) {
+			// a compression is still writing it, the next sweep picks it up
+			if debug {
+				Infof("retention: skipping %s, compression in flight", file)
+			}
+			continue
+		}
+
+		if l.trashGrace > 0 {
+			if err := l.moveToTrash(file); err != nil {
+				Errorf("failed to trash outdated file: %s, error: %s", file, err)
+			} else if debug {
+				Infof("retention: trashed %s", file)
+			}
+			continue
+		}
+
+		size := l.statSizeForDelete(file)
+		if err := os.Remove(file); err != nil {
+			Errorf("failed to remove outdated file: %s", file)
+			l.reportDelete(file, size, err)
+		} else {
+			if debug {
+				Infof("retention: removed %s", file)
+			}
+			atomic.AddInt64(&l.stats.deletions, 1)
+			l.reportDelete(file, size, nil)
+		}
+	}
+
+	if l.trashGrace > 0 {
+		l.sweepTrash()
+	}
+}
+
+// statSizeForDelete grabs the size of file right before its deletion for the
+// OnDelete callback, zero when no callback is registered or the stat fails.
+func (l *RotateLogger) statSizeForDelete(file string) int64 {
+	if l.onDelete == nil {
+		return 0
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+func (l *RotateLogger) reportDelete(file string, size int64, err error) {
+	if l.onDelete != nil {
+		l.onDelete(file, size, err)
+	}
+}
+
+func (l *RotateLogger) moveToTrash(file string) error {
+	trashDir := filepath.Join(filepath.Dir(l.filename), trashDirName)
+	if err := os.MkdirAll(trashDir, defaultDirMode); err != nil {
+		return err
+	}
+
+	target := filepath.Join(trashDir, filepath.Base(file))
+	if err := os.Rename(file, target); err != nil {
+		return err
+	}
+
+	// the tombstone records when the file was trashed,
+	// the sweep hard-deletes both once the grace period has elapsed
+	return os.WriteFile(target+tombstoneExt,
+		[]byte(timeNow().Format(rfc3339DateFormat)), defaultFileMode)
+}
+
+func (l *RotateLogger) sweepTrash() {
+	trashDir := filepath.Join(filepath.Dir(l.filename), trashDirName)
+	tombstones, err := filepath.Glob(filepath.Join(trashDir, "*"+tombstoneExt))
+	if err != nil {
+		Errorf("failed to sweep trashed log files, error: %s", err)
+		return
+	}
+
+	for _, tombstone := range tombstones {
+		data, err := os.ReadFile(tombstone)
+		if err != nil {
+			continue
+		}
+
+		trashed, err := time.Parse(rfc3339DateFormat, strings.TrimSpace(string(data)))
+		if err != nil || timeNow().Sub(trashed) < l.trashGrace {
+			continue
+		}
+
+		file := strings.TrimSuffix(tombstone, tombstoneExt)
+		size := l.statSizeForDelete(file)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			Errorf("failed to remove trashed file: %s", file)
+			l.reportDelete(file, size, err)
+			continue
+		}
+		os.Remove(tombstone)
+		atomic.AddInt64(&l.stats.deletions, 1)
+		l.reportDelete(file, size, nil)
+	}
+}
+
+func (l *RotateLogger) pruneEmptyBackupFiles() {
+	patterner, ok := l.getRule().(backupPatterner)
+	if !ok {
+		return
+	}
+
+	files, err := filepath.Glob(patterner.backupPattern(false))
+	if err != nil {
+		Errorf("failed to prune empty backup files, error: %s", err)
+		return
+	}
+
 	for _, file := range files {
+		if info, err := os.Stat(file); err != nil || info.Size() > 0 {
+			continue
+		}
 		if err := os.Remove(file); err != nil {
-			Errorf("failed to remove outdated file: %s", file)
+			Errorf("failed to remove empty backup file: %s", file)
+		}
+	}
+}
+
+func (l *RotateLogger) postRotate(file string) {
+	atomic.AddInt32(&l.rotating, 1)
+	go func() {
+		defer atomic.AddInt32(&l.rotating, -1)
+
+		if l.bgWorkers != nil {
+			l.bgWorkers <- lang.Placeholder
+			defer func() {
+				<-l.bgWorkers
+			}()
+		}
+
+		// we cannot use threading.GoSafe here, because of import cycle.
+		if l.compressAfter > 0 {
+			l.compressAgedBackups()
+		} else {
+			l.maybeCompressFile(file)
+		}
+		l.maybeEncryptFile(file)
+		l.maybeDeleteOutdatedFiles()
+		if l.symlinkCurrent {
+			l.updateCurrentSymlink(l.finalBackupPath(file))
+		}
+		if l.onRotate != nil {
+			l.onRotate(l.filename, l.finalBackupPath(file))
+		}
+	}()
+}
+
+// updateCurrentSymlink points the .current symlink next to the log file at
+// target, replacing the previous link. The link target is relative, so the
+// log directory can be remounted under another path without breaking it.
+func (l *RotateLogger) updateCurrentSymlink(target string) {
+	link := l.filename + currentLinkExt
+	// a template namer may place backups in subdirectories, so resolve the
+	// path relative to the link's directory instead of taking the base name
+	rel, err := filepath.Rel(filepath.Dir(l.filename), target)
+	if err != nil {
+		rel = target
+	}
+	os.Remove(link)
+	if err := os.Symlink(rel, link); err != nil {
+		// e.g. Windows without the symlink privilege, warn once and move on
+		if atomic.CompareAndSwapInt32(&l.symlinkWarned, 0, 1) {
+			Errorf("failed to update current symlink: %s, not retried", err)
+		}
+	}
+}
+
+// finalBackupPath resolves where the rotated out file ended up after the
+// optional compression and encryption steps renamed it.
+func (l *RotateLogger) finalBackupPath(file string) string {
+	compressedExt := gzipExt
+	if l.compressor != nil {
+		compressedExt = l.compressor.Extension()
+	}
+
+	for _, candidate := range []string{
+		file + compressedExt + encExt,
+		file + compressedExt,
+		file + encExt,
+	} {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+
+	return file
+}
+
+func (l *RotateLogger) rotate() error {
+	atomic.AddInt32(&l.rotating, 1)
+	defer atomic.AddInt32(&l.rotating, -1)
+	start := time.Now()
+	defer func() {
+		l.rotateLatency.record(time.Since(start))
+	}()
+
+	if l.copyTruncate && l.fp != nil {
+		return l.rotateCopyTruncate()
+	}
+
+	l.writeTrailer()
+	l.closeStream()
+	if l.fp != nil {
+		err := l.fp.Close()
+		l.fp = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	// postRotate must only ever see a backup that exists and was renamed,
+	// compressing a path that no longer holds the intended content corrupts
+	// the backup chain
+	var backupFilename string
+	_, err := os.Stat(l.filename)
+	if err == nil && len(l.backup) > 0 {
+		backupFilename = l.freshBackupFilename()
+		err = l.renameBackup(l.filename, backupFilename)
+		if err != nil {
+			return err
+		}
+		l.markLastBackup(backupFilename)
+
+		if l.manifest {
+			l.appendManifest(backupFilename)
+		}
+		l.postRotate(backupFilename)
+	} else if err != nil {
+		if os.IsNotExist(err) {
+			Errorf("log file %s vanished before rotating, skipping the backup", l.filename)
+		} else {
+			Errorf("failed to stat log file %s before rotating, error: %s", l.filename, err)
+		}
+	}
+
+	l.backup = l.rule.BackupFileName()
+	if l.fp, err = l.createFile(); err == nil {
+		fs.CloseOnExec(l.fp)
+		l.setupStream()
+		atomic.AddInt64(&l.stats.rotations, 1)
+		l.writeRotationMarker(backupFilename)
+	}
+
+	return err
+}
+
+// renameBackup moves the rotated out file to dst, falling back to copy and
+// remove when the backup path lives on another filesystem and the rename
+// fails with EXDEV, e.g. a mounted log volume with a local temp area.
+func (l *RotateLogger) renameBackup(src, dst string) error {
+	// a date-structured naming scheme may place the backup in a
+	// subdirectory that doesn't exist yet
+	if dir := filepath.Dir(dst); dir != filepath.Dir(src) {
+		if err := os.MkdirAll(dir, l.makeDirMode()); err != nil {
+			return err
+		}
+	}
+
+	err := osRename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		l.makeFileMode(defaultFileMode))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// rotateCopyTruncate seals a backup without giving up the open fd: the current
+// contents are copied into the backup file and the log file is truncated in
+// place, so writes through an externally rotated (renamed) path still land in
+// the file the fd points at.
+func (l *RotateLogger) rotateCopyTruncate() error {
+	backupFilename := l.freshBackupFilename()
+	if dir := filepath.Dir(backupFilename); dir != filepath.Dir(l.filename) {
+		if err := os.MkdirAll(dir, l.makeDirMode()); err != nil {
+			return err
+		}
+	}
+
+	src, err := os.Open(l.filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(backupFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		l.makeFileMode(defaultFileMode))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	if err = l.fp.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = l.fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	l.markLastBackup(backupFilename)
+	if l.manifest {
+		l.appendManifest(backupFilename)
+	}
+	l.postRotate(backupFilename)
+	l.backup = l.rule.BackupFileName()
+	atomic.AddInt64(&l.stats.rotations, 1)
+	l.writeRotationMarker(backupFilename)
+
+	return nil
+}
+
+func (l *RotateLogger) appendManifest(file string) {
+	record := manifestRecord{
+		File: file,
+		Time: timeNow().Format(rfc3339DateFormat),
+	}
+	if l.manifestChained {
+		record.Prev = l.lastManifestHash
+		record.Hash = hashManifestRecord(record)
+		l.lastManifestHash = record.Hash
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		Errorf("failed to marshal manifest record, error: %s", err)
+		return
+	}
+
+	f, err := os.OpenFile(l.filename+manifestExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+		defaultFileMode)
+	if err != nil {
+		Errorf("failed to open manifest file, error: %s", err)
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
+
+func (l *RotateLogger) loadManifestHash() {
+	f, err := os.Open(l.filename + manifestExt)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var last string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Text()) > 0 {
+			last = scanner.Text()
+		}
+	}
+
+	var record manifestRecord
+	if err := json.Unmarshal([]byte(last), &record); err == nil {
+		l.lastManifestHash = record.Hash
+	}
+}
+
+// writeRotationMarker writes the in-band rotation marker as the first line of
+// the fresh file. The marker bytes are not counted against the size limit, the
+// callers reset currentSize right after the rotation and the handful of bytes
+// don't matter at MB granularity.
+func (l *RotateLogger) writeRotationMarker(backup string) {
+	if !l.rotationMarker || l.fp == nil || len(backup) == 0 {
+		return
+	}
+
+	transition := fmt.Sprintf("%s->%s", backup, l.filename)
+	var line []byte
+	if atomic.LoadUint32(&encoding) == plainEncodingType {
+		line = []byte(fmt.Sprintf("%s%c%s%c%s\n", getTimestamp(), plainEncodingSep,
+			rotatedKey, plainEncodingSep, transition))
+	} else {
+		data, err := json.Marshal(map[string]string{
+			rotatedKey:   transition,
+			timestampKey: getTimestamp(),
+		})
+		if err != nil {
+			Errorf("failed to marshal rotation marker, error: %s", err)
+			return
+		}
+		line = append(data, '\n')
+	}
+
+	if l.gzStream != nil {
+		l.gzStream.Write(line)
+		l.gzStream.Flush()
+	} else {
+		l.fp.Write(line)
+	}
+}
+
+func (l *RotateLogger) writeTrailer() {
+	if l.trailer == nil || l.fp == nil {
+		return
+	}
+
+	v := l.trailer()
+	if len(v) == 0 {
+		return
+	}
+
+	if l.gzStream != nil {
+		l.gzStream.Write(v)
+	} else {
+		l.fp.Write(v)
+	}
+	l.currentSize += len(v)
+}
+
+func (l *RotateLogger) sealOnClose() error {
+	l.writeTrailer()
+	l.closeStream()
+	if l.fp == nil {
+		return nil
+	}
+
+	if err := l.fp.Sync(); err != nil {
+		return err
+	}
+	if err := l.fp.Close(); err != nil {
+		return err
+	}
+	l.fp = nil
+
+	backup := l.freshBackupFilename()
+	if err := l.renameBackup(l.filename, backup); err != nil {
+		return err
+	}
+
+	buf := l.copyBufferPool.Get().([]byte)
+	defer l.copyBufferPool.Put(buf)
+	compressLogFile(backup, buf, l.compressConflict, l.compressIORate, l.compressLevel)
+	atomic.AddInt64(&l.stats.compressions, 1)
+	return nil
+}
+
+func (l *RotateLogger) summary() string {
+	return fmt.Sprintf("filename: %s, lines: %d, bytes: %d, rotations: %d, "+
+		"compressions: %d, deletions: %d, dropped: %d", l.filename,
+		atomic.LoadInt64(&l.stats.lines), atomic.LoadInt64(&l.stats.bytes),
+		atomic.LoadInt64(&l.stats.rotations), atomic.LoadInt64(&l.stats.compressions),
+		atomic.LoadInt64(&l.stats.deletions), atomic.LoadInt64(&l.stats.dropped))
+}
+
+func (l *RotateLogger) startWorker() {
+	l.waitGroup.Add(1)
+
+	go func() {
+		defer l.waitGroup.Done()
+
+		var watchChan <-chan time.Time
+		if l.recreateOnMissing || len(l.triggerFile) > 0 {
+			ticker := time.NewTicker(watchInterval)
+			defer ticker.Stop()
+			watchChan = ticker.C
+		}
+
+		var flushChan <-chan time.Time
+		if l.memBufSize > 0 && l.memFlushInterval > 0 {
+			ticker := time.NewTicker(l.memFlushInterval)
+			defer ticker.Stop()
+			flushChan = ticker.C
+		}
+
+		var batchChan <-chan time.Time
+		if l.batchSize > 0 {
+			interval := l.batchFlush
+			if interval <= 0 {
+				interval = defaultBatchFlush
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			batchChan = ticker.C
+		}
+
+		var retryChan <-chan time.Time
+		if l.lazyRetry > 0 {
+			ticker := time.NewTicker(l.lazyRetry)
+			defer ticker.Stop()
+			retryChan = ticker.C
+		}
+
+		// sweep outdated backups on a schedule too, a service that restarts
+		// before ever crossing a rotation boundary otherwise never cleans up
+		cleanupInterval := l.cleanupInterval
+		if cleanupInterval <= 0 {
+			cleanupInterval = defaultCleanupInterval
+		}
+		cleanupTicker := time.NewTicker(cleanupInterval)
+		defer cleanupTicker.Stop()
+		cleanupChan := cleanupTicker.C
+
+		var rotateCheckChan <-chan time.Time
+		if l.rotateCheckInterval > 0 {
+			ticker := time.NewTicker(l.rotateCheckInterval)
+			defer ticker.Stop()
+			rotateCheckChan = ticker.C
+		}
+
+		var syncChan <-chan time.Time
+		if l.flushInterval > 0 {
+			ticker := time.NewTicker(l.flushInterval)
+			defer ticker.Stop()
+			syncChan = ticker.C
+		}
+
+		for {
+			select {
+			case event := <-l.channel:
+				if l.batchSize > 0 {
+					l.batchOrWrite(event)
+				} else {
+					l.bufferOrWrite(event, 1)
+				}
+			case <-batchChan:
+				l.flushBatch()
+			case req := <-l.capture:
+				l.lockSync()
+				l.flushBatch()
+				l.drainChannel()
+				result := l.captureCurrent()
+				l.unlockSync()
+				req <- result
+			case req := <-l.forced:
+				l.lockSync()
+				l.flushBatch()
+				l.drainChannel()
+				err := l.rotateNow()
+				l.unlockSync()
+				req <- err
+			case req := <-l.reconf:
+				l.lockSync()
+				// writes accepted before the call were promised the old
+				// rule, land them before swapping
+				l.flushBatch()
+				l.drainChannel()
+				l.ruleLock.Lock()
+				l.rule = req.rule
+				if !req.keepCompress {
+					l.compress = req.compress
+				}
+				l.ruleLock.Unlock()
+				l.backup = l.rule.BackupFileName()
+				l.unlockSync()
+				close(req.done)
+			case <-flushChan:
+				l.lockSync()
+				l.flushMemoryBuffer()
+				l.unlockSync()
+			case <-retryChan:
+				l.lockSync()
+				l.maybeOpenLazily()
+				l.unlockSync()
+			case <-cleanupChan:
+				l.lockSync()
+				l.maybeDeleteOutdatedFiles()
+				l.unlockSync()
+			case <-rotateCheckChan:
+				l.lockSync()
+				l.maybeRotateIdle()
+				l.unlockSync()
+			case <-syncChan:
+				l.lockSync()
+				l.syncFile()
+				l.unlockSync()
+			case <-watchChan:
+				l.lockSync()
+				if l.recreateOnMissing {
+					l.maybeRecreateFile()
+				}
+				if len(l.triggerFile) > 0 {
+					l.maybeRotateOnTrigger()
+				}
+				l.unlockSync()
+			case <-l.done:
+				// accepted writes may still sit in the batch and the channel,
+				// flush and drain them so no line accepted before Close is lost
+				l.lockSync()
+				l.flushBatch()
+				l.drainChannel()
+				l.flushMemoryBuffer()
+				l.unlockSync()
+				return
+			}
+		}
+	}()
+}
+
+func (l *RotateLogger) drainChannel() {
+	for {
+		select {
+		case event := <-l.channel:
+			l.bufferOrWrite(event, 1)
+		default:
+			return
+		}
+	}
+}
+
+func (l *RotateLogger) captureCurrent() captureResult {
+	l.flushMemoryBuffer()
+
+	data, err := os.ReadFile(l.filename)
+	if err != nil {
+		return captureResult{err: err}
+	}
+
+	if err := l.rotate(); err != nil {
+		return captureResult{err: err}
+	}
+
+	l.rule.MarkRotated()
+	l.currentSize = 0
+	return captureResult{data: data}
+}
+
+// maybeRotateIdle rotates when the rule reports a passed boundary even though
+// no write arrived, so the timer-driven check mirrors the write path.
+func (l *RotateLogger) maybeRotateIdle() {
+	if atomic.LoadInt32(&l.paused) != 0 || !l.rule.ShallRotate(l.currentSize, 0) {
+		return
+	}
+	if l.rotateGuard != nil && !l.rotateGuard() {
+		return
+	}
+
+	l.flushBatch()
+	l.flushMemoryBuffer()
+	if err := l.rotate(); err != nil {
+		log.Println(err)
+		l.reportError(err)
+		return
+	}
+
+	l.rule.MarkRotated()
+	l.currentSize = 0
+}
+
+// rotateNow runs a forced rotation on the worker goroutine.
+func (l *RotateLogger) rotateNow() error {
+	l.flushMemoryBuffer()
+
+	if err := l.rotate(); err != nil {
+		return err
+	}
+
+	l.rule.MarkRotated()
+	l.currentSize = 0
+	return nil
+}
+
+func (l *RotateLogger) write(v []byte) {
+	l.writeLines(v, 1)
+}
+
+// writeLines is write carrying the number of messages inside v, so batched
+// and memory-buffered flushes count every message in the lines stat.
+func (l *RotateLogger) writeLines(v []byte, lines int64) {
+	if len(l.recordSep) > 0 && !bytes.HasSuffix(v, l.recordSep) {
+		v = append(v, l.recordSep...)
+	}
+
+	if l.fp == nil && l.lazyRetry > 0 {
+		l.bufferPending(v, lines)
+		return
+	}
+
+	if atomic.LoadInt32(&l.paused) == 0 && l.rule.ShallRotate(l.currentSize, len(v)) &&
+		(l.rotateGuard == nil || l.rotateGuard()) {
+		if err := l.rotate(); err != nil {
+			log.Println(err)
+			l.reportError(err)
+		} else {
+			l.rule.MarkRotated()
+			l.currentSize = 0
+		}
+	}
+	// a failed rotate (e.g. on a full disk) leaves the file closed; retry the
+	// open on every write so logging resumes once the condition clears
+	if l.fp == nil {
+		l.reopenFile()
+	}
+	if l.fp != nil {
+		if l.gzStream != nil {
+			l.gzStream.Write(v)
+			l.gzStream.Flush()
+		} else {
+			l.fp.Write(v)
 		}
+		l.currentSize += len(v)
+		atomic.AddInt64(&l.stats.lines, lines)
+		atomic.AddInt64(&l.stats.bytes, int64(len(v)))
+	} else {
+		atomic.AddInt64(&l.stats.droppedBytes, int64(len(v)))
+		log.Printf("log file %s is not open, dropped %d bytes", l.filename, len(v))
 	}
 }
 
-func (l *RotateLogger) postRotate(file string) {
-	go func() {
-		// we cannot use threading.GoSafe here, because of import cycle.
-		l.maybeCompressFile(file)
-		l.maybeDeleteOutdatedFiles()
-	}()
+// reportError delivers a rotation failure to the OnError callback, wrapped
+// with the file involved.
+func (l *RotateLogger) reportError(err error) {
+	if l.onError != nil {
+		l.onError(&RotateError{Filename: l.filename, Err: err})
+	}
 }
 
-func (l *RotateLogger) rotate() error {
-	if l.fp != nil {
-		err := l.fp.Close()
+func (l *RotateLogger) reopenFile() {
+	var err error
+	if _, err = os.Stat(l.filename); err != nil {
+		l.fp, err = l.createFile()
+	} else {
+		l.fp, err = os.OpenFile(l.filename, os.O_APPEND|os.O_WRONLY|l.extraFlags,
+			defaultFileMode)
+	}
+	if err != nil {
 		l.fp = nil
-		if err != nil {
+		return
+	}
+
+	fs.CloseOnExec(l.fp)
+	l.setupStream()
+}
+
+func compressLogFile(file string, buf []byte, conflict CompressConflictPolicy, rate, level int) {
+	start := time.Now()
+	Infof("compressing log file: %s", file)
+	if err := gzipFile(file, buf, conflict, rate, level); err != nil {
+		Errorf("compress error: %s", err)
+	} else {
+		Infof("compressed log file: %s, took %s", file, time.Since(start))
+	}
+}
+
+// gzipCompressor is the built-in gzip codec behind the Compressor interface.
+type gzipCompressor struct {
+	level int
+}
+
+// NewGzipCompressor returns the built-in gzip compression as a Compressor at
+// the given level, useful for composing with WithCompressorSelector.
+func NewGzipCompressor(level int) Compressor {
+	return gzipCompressor{level: level}
+}
+
+func (c gzipCompressor) Compress(src string) (string, error) {
+	buf := make([]byte, defaultCopyBufferSize)
+	if err := gzipFile(src, buf, CompressConflictRename, 0, c.level); err != nil {
+		return "", err
+	}
+
+	return src + gzipExt, nil
+}
+
+func (c gzipCompressor) Extension() string {
+	return gzipExt
+}
+
+// NewDailyBackupNamer returns a BackupNamer that names backups
+// the same way DailyRotateRule does by default.
+func NewDailyBackupNamer(delimiter string) BackupNamer {
+	return dailyBackupNamer{delimiter: delimiter}
+}
+
+// NewSizeLimitBackupNamer returns a BackupNamer that names backups
+// the same way SizeLimitRotateRule does by default.
+func NewSizeLimitBackupNamer(delimiter string) BackupNamer {
+	return sizeBackupNamer{delimiter: delimiter}
+}
+
+func (n dailyBackupNamer) Name(base string, t time.Time, _ int) string {
+	return fmt.Sprintf("%s%s%s", base, n.delimiter, t.Format(dateFormat))
+}
+
+func (n dailyBackupNamer) Parse(base, name string) (time.Time, int, bool) {
+	prefix := base + n.delimiter
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, 0, false
+	}
+
+	t, err := time.ParseInLocation(dateFormat, name[len(prefix):], time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return t, 0, true
+}
+
+func (n sizeBackupNamer) Name(base string, t time.Time, _ int) string {
+	dir := filepath.Dir(base)
+	logname := filepath.Base(base)
+	ext := filepath.Ext(base)
+	prefix := logname[:len(logname)-len(ext)]
+	return filepath.Join(dir, fmt.Sprintf("%s%s%s%s", prefix, n.delimiter,
+		t.Format(rfc3339DateFormat), ext))
+}
+
+// NewTemplateBackupNamer returns a BackupNamer rendering backup names from
+// the given text/template, e.g. `{{.Prefix}}-{{.Time.Format "20060102"}}{{.Ext}}`.
+// The template must format .Time exactly once, the layout it uses also drives
+// parsing the rendered names back for retention. The rendered name is placed
+// in the directory of the log file. It may contain path separators, e.g.
+// `{{.Time.Format "2006/01/02"}}/{{.Prefix}}{{.Ext}}`, spreading the backups
+// over date-structured subdirectories that are created on rotation.
+func NewTemplateBackupNamer(tmpl string) (BackupNamer, error) {
+	parsed, err := template.New("backup").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &templateBackupNamer{tmpl: parsed}
+	if _, _, _, err := n.probe("app.log"); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (p layoutProbe) Format(layout string) string {
+	*p.layout = layout
+	*p.calls++
+	return templateTimeSentinel
+}
+
+// probe renders the template for base with a probe in place of the rotation
+// time, returning the name parts around the timestamp and the time layout.
+func (n *templateBackupNamer) probe(base string) (pre, post, layout string, err error) {
+	logname := filepath.Base(base)
+	ext := filepath.Ext(base)
+	var calls int
+	var buf strings.Builder
+	data := backupNameData{
+		Prefix: logname[:len(logname)-len(ext)],
+		Ext:    ext,
+		Time:   layoutProbe{layout: &layout, calls: &calls},
+	}
+	if err = n.tmpl.Execute(&buf, data); err != nil {
+		return "", "", "", err
+	}
+	if calls != 1 {
+		return "", "", "", fmt.Errorf(
+			"backup name template must format .Time exactly once, got %d times", calls)
+	}
+
+	parts := strings.SplitN(buf.String(), templateTimeSentinel, 2)
+	return parts[0], parts[1], layout, nil
+}
+
+func (n *templateBackupNamer) Name(base string, t time.Time, _ int) string {
+	pre, post, layout, err := n.probe(base)
+	if err != nil {
+		Errorf("failed to render backup name template: %s, fallback to default", err)
+		return base + backupFileDelimiter + t.Format(dateFormat)
+	}
+
+	return filepath.Join(filepath.Dir(base), pre+t.Format(layout)+post)
+}
+
+func (n *templateBackupNamer) Parse(base, name string) (time.Time, int, bool) {
+	pre, post, layout, err := n.probe(base)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	// filepath.Walk hands out cleaned paths, so compare cleaned forms: a bare
+	// relative base would otherwise produce a ./ prefix that never matches.
+	// The separator stays explicit, filepath.Join would swallow it when the
+	// template starts with the timestamp.
+	name = filepath.Clean(name)
+	prefix := pre
+	if dir := filepath.Dir(base); dir != "." {
+		prefix = dir + string(os.PathSeparator) + pre
+	}
+	if len(name) <= len(prefix)+len(post) || !strings.HasPrefix(name, prefix) ||
+		!strings.HasSuffix(name, post) {
+		return time.Time{}, 0, false
+	}
+
+	t, err := time.ParseInLocation(layout, name[len(prefix):len(name)-len(post)], time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return t, 0, true
+}
+
+func (n sizeBackupNamer) Parse(base, name string) (time.Time, int, bool) {
+	dir := filepath.Dir(base)
+	logname := filepath.Base(base)
+	ext := filepath.Ext(base)
+	prefix := filepath.Join(dir, logname[:len(logname)-len(ext)]+n.delimiter)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return time.Time{}, 0, false
+	}
+
+	t, err := time.Parse(rfc3339DateFormat, name[len(prefix):len(name)-len(ext)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return t, 0, true
+}
+
+// outdatedFilesByNamer scans the directory of base, and selects the backups
+// recognized by namer that exceed the age window in hours or the backup count.
+// compressedExt is the extension the compression step appends to backups,
+// stripped before the names are parsed.
+func outdatedFilesByNamer(namer BackupNamer, base string, hours, maxBackups int,
+	compressedExt string) []string {
+	type backup struct {
+		file string
+		when time.Time
+		seq  int
+	}
+
+	// walk instead of glob, a naming scheme may spread the backups over
+	// date-structured subdirectories
+	var backups []backup
+	err := filepath.Walk(filepath.Dir(base), func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
 			return err
 		}
+
+		name := strings.TrimSuffix(file, compressedExt)
+		if when, seq, ok := namer.Parse(base, name); ok {
+			backups = append(backups, backup{file: file, when: when, seq: seq})
+		}
+		return nil
+	})
+	if err != nil {
+		Errorf("failed to delete outdated log files, error: %s", err)
+		return nil
 	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].when.Equal(backups[j].when) {
+			return backups[i].seq < backups[j].seq
+		}
+		return backups[i].when.Before(backups[j].when)
+	})
 
-	_, err := os.Stat(l.filename)
-	if err == nil && len(l.backup) > 0 {
-		backupFilename := l.getBackupFilename()
-		err = os.Rename(l.filename, backupFilename)
-		if err != nil {
-			return err
+	outdated := make(map[string]lang.PlaceholderType)
+
+	if maxBackups > 0 && len(backups) > maxBackups {
+		for _, b := range backups[:len(backups)-maxBackups] {
+			outdated[b.file] = lang.Placeholder
 		}
+		backups = backups[len(backups)-maxBackups:]
+	}
 
-		l.postRotate(backupFilename)
+	if hours > 0 {
+		boundary := timeNow().Add(-time.Hour * time.Duration(hours))
+		for _, b := range backups {
+			if b.when.Before(boundary) {
+				outdated[b.file] = lang.Placeholder
+			} else {
+				break
+			}
+		}
 	}
 
-	l.backup = l.rule.BackupFileName()
-	if l.fp, err = os.Create(l.filename); err == nil {
-		fs.CloseOnExec(l.fp)
+	var result []string
+	for k := range outdated {
+		result = append(result, k)
 	}
+	return result
+}
 
-	return err
+// parseCronSpec parses a standard five-field cron spec into a schedule.
+func parseCronSpec(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec must have 5 fields, got %q", spec)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var masks [5]uint64
+	var stars [5]bool
+	for i, field := range fields {
+		mask, star, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		masks[i] = mask
+		stars[i] = star
+	}
+
+	return &cronSchedule{
+		minutes: masks[0],
+		hours:   masks[1],
+		doms:    masks[2],
+		months:  masks[3],
+		dows:    masks[4],
+		domStar: stars[2],
+		dowStar: stars[4],
+	}, nil
 }
 
-func (l *RotateLogger) startWorker() {
-	l.waitGroup.Add(1)
+func parseCronField(field string, min, max int) (uint64, bool, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart := part, ""
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			rangePart, stepPart = part[:idx], part[idx+1:]
+		}
 
-	go func() {
-		defer l.waitGroup.Done()
+		step := 1
+		if len(stepPart) > 0 {
+			v, err := strconv.Atoi(stepPart)
+			if err != nil || v <= 0 {
+				return 0, false, fmt.Errorf("bad cron step in %q", field)
+			}
+			step = v
+		}
 
-		for {
-			select {
-			case event := <-l.channel:
-				l.write(event)
-			case <-l.done:
-				return
+		lo, hi := min, max
+		if rangePart != "*" {
+			ends := strings.SplitN(rangePart, "-", 2)
+			v, err := strconv.Atoi(ends[0])
+			if err != nil {
+				return 0, false, fmt.Errorf("bad cron value in %q", field)
+			}
+			lo, hi = v, v
+			if len(ends) == 2 {
+				if hi, err = strconv.Atoi(ends[1]); err != nil {
+					return 0, false, fmt.Errorf("bad cron range in %q", field)
+				}
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, false, fmt.Errorf("cron value out of range in %q", field)
 			}
 		}
-	}()
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+
+	return mask, field == "*", nil
 }
 
-func (l *RotateLogger) write(v []byte) {
-	if l.rule.ShallRotate(l.currentSize, len(v)) {
-		if err := l.rotate(); err != nil {
-			log.Println(err)
-		} else {
-			l.rule.MarkRotated()
-			l.currentSize = 0
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 || s.hours&(1<<uint(t.Hour())) == 0 ||
+		s.months&(1<<uint(int(t.Month()))) == 0 {
+		return false
+	}
+
+	domMatch := s.doms&(1<<uint(t.Day())) != 0
+	dowMatch := s.dows&(1<<uint(int(t.Weekday()))) != 0
+	// standard cron semantics: with both day fields restricted, either one firing matches
+	if !s.domStar && !s.dowStar {
+		return domMatch || dowMatch
+	}
+
+	return domMatch && dowMatch
+}
+
+// next returns the first scheduled time strictly after from, scanning the
+// local wall-clock minute by minute, so DST gaps and overlaps are each
+// evaluated exactly once. The scan is bounded to two years, far beyond the
+// largest gap of any valid schedule; a schedule that never fires returns
+// the zero time.
+func (s *cronSchedule) next(from time.Time) time.Time {
+	t := from.Truncate(time.Minute)
+	for i := 0; i < 2*366*hoursPerDay*60; i++ {
+		t = t.Add(time.Minute)
+		if s.matches(t) {
+			return t
 		}
 	}
-	if l.fp != nil {
-		l.fp.Write(v)
-		l.currentSize += len(v)
+
+	return time.Time{}
+}
+
+// checkRuleFilename verifies that rule was built for filename, for rules
+// exposing the base name they were constructed with. Rules without a Filename
+// getter are trusted as-is.
+func checkRuleFilename(rule RotateRule, filename string) error {
+	named, ok := rule.(interface{ Filename() string })
+	if !ok {
+		return nil
 	}
+
+	ruleFile := named.Filename()
+	if len(ruleFile) == 0 || filepath.Clean(ruleFile) == filepath.Clean(filename) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: rule built for %s, logger writes %s",
+		ErrRuleFilenameMismatch, ruleFile, filename)
 }
 
-func compressLogFile(file string) {
-	start := time.Now()
-	Infof("compressing log file: %s", file)
-	if err := gzipFile(file); err != nil {
-		Errorf("compress error: %s", err)
-	} else {
-		Infof("compressed log file: %s, took %s", file, time.Since(start))
+func nonNegative(value int, name string) int {
+	if value < 0 {
+		Errorf("%s must be non-negative, got %d, fallback to 0", name, value)
+		return 0
+	}
+
+	return value
+}
+
+// validateBackupDelimiter reports whether delimiter separates the filename
+// from the backup timestamp unambiguously. An empty delimiter or one sharing
+// the timestamp alphabet produces backup names that cannot be told apart from
+// the timestamp itself. The long-standing default "-" is allowed even though
+// dates contain it, rejecting it would break every existing deployment.
+func validateBackupDelimiter(delimiter string) error {
+	if len(delimiter) == 0 {
+		return ErrEmptyBackupDelimiter
+	}
+	if strings.ContainsAny(delimiter, "0123456789:TZ+.") {
+		return fmt.Errorf("backup delimiter %q collides with RFC3339 timestamps", delimiter)
+	}
+
+	return nil
+}
+
+// safeDelimiter is the fallback counterpart of validateBackupDelimiter for
+// the rule constructors that cannot return an error, invalid delimiters are
+// logged and replaced with the package default.
+func safeDelimiter(delimiter string) string {
+	if err := validateBackupDelimiter(delimiter); err != nil {
+		Errorf("%s, fallback to %q", err, backupFileDelimiter)
+		return backupFileDelimiter
+	}
+
+	return delimiter
+}
+
+// VerifyManifest checks the hash chain of the given manifest file,
+// returning an error if any record is missing, altered or out of order.
+func VerifyManifest(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var prev string
+	var line int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Text()) == 0 {
+			continue
+		}
+
+		var record manifestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("manifest record %d is not valid json: %w", line, err)
+		}
+		if record.Prev != prev {
+			return fmt.Errorf("manifest chain broken at record %d", line)
+		}
+		if expected := hashManifestRecord(manifestRecord{
+			File: record.File,
+			Time: record.Time,
+			Prev: record.Prev,
+		}); record.Hash != expected {
+			return fmt.Errorf("manifest record %d has a mismatched hash", line)
+		}
+		prev = record.Hash
 	}
+
+	return scanner.Err()
+}
+
+func hashManifestRecord(record manifestRecord) string {
+	sum := sha256.Sum256([]byte(record.File + "|" + record.Time + "|" + record.Prev))
+	return hex.EncodeToString(sum[:])
 }
 
 func getNowDate() string {
-	return time.Now().Format(dateFormat)
+	return timeNow().Format(dateFormat)
+}
+
+func getNowHour() string {
+	return timeNow().Format(hourFormat)
+}
+
+func getNowMonth() string {
+	return timeNow().Format(monthFormat)
+}
+
+func getNowWeek() string {
+	return formatWeek(timeNow())
+}
+
+// formatWeek renders the ISO week of t, e.g. 2023-W05. The zero padded form
+// keeps the names sorting chronologically for the retention comparison.
+func formatWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
 }
 
 func getNowDateInRFC3339Format() string {
-	return time.Now().Format(rfc3339DateFormat)
+	return timeNow().Format(rfc3339DateFormat)
 }
 
-func gzipFile(file string) error {
+func gzipFile(file string, buf []byte, conflict CompressConflictPolicy, rate, level int) error {
+	target := fmt.Sprintf("%s%s", file, gzipExt)
+	if _, err := os.Stat(target); err == nil {
+		if conflict == CompressConflictSkip {
+			Errorf("compression target already exists, skipping compression: %s", target)
+			return nil
+		}
+
+		// pick a unique name, never clobber a prior archive; the sequence goes
+		// before the filename extension like uniqueBackupName, so the renamed
+		// archive still matches the glob patterns of the rules
+		ext := filepath.Ext(file)
+		stem := strings.TrimSuffix(file, ext)
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s.%d%s%s", stem, i, ext, gzipExt)
+			if _, err := os.Stat(candidate); os.IsNotExist(err) {
+				target = candidate
+				break
+			}
+		}
+	}
+
 	in, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(fmt.Sprintf("%s%s", file, gzipExt))
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFileMode)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
 
-	w := gzip.NewWriter(out)
-	if _, err = io.Copy(w, in); err != nil {
+	var reader io.Reader = in
+	if rate > 0 {
+		reader = newRateLimitedReader(in, rate)
+	}
+
+	w, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		// level was validated by the option, guard against direct callers
+		w = gzip.NewWriter(out)
+	}
+	if _, err = io.CopyBuffer(w, reader, buf); err != nil {
 		return err
 	} else if err = w.Close(); err != nil {
 		return err
@@ -439,3 +4450,77 @@ func gzipFile(file string) error {
 
 	return os.Remove(file)
 }
+
+func (r *latencyRecorder) record(d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.samples == nil {
+		r.samples = make([]time.Duration, latencySampleCount)
+	}
+
+	r.samples[r.next] = d
+	r.next++
+	if r.next == len(r.samples) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+func (r *latencyRecorder) snapshot() LatencySnapshot {
+	r.lock.Lock()
+	size := r.next
+	if r.full {
+		size = len(r.samples)
+	}
+	sorted := make([]time.Duration, size)
+	copy(sorted, r.samples[:size])
+	r.lock.Unlock()
+
+	if size == 0 {
+		return LatencySnapshot{}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	return LatencySnapshot{
+		P50: sorted[(size-1)/2],
+		P95: sorted[(size-1)*95/100],
+		Max: sorted[size-1],
+	}
+}
+
+// rateLimitedReader paces the reads of the underlying reader
+// to an average of bytesPerSec.
+type rateLimitedReader struct {
+	reader      io.Reader
+	bytesPerSec int
+	start       time.Time
+	consumed    int
+}
+
+func newRateLimitedReader(reader io.Reader, bytesPerSec int) *rateLimitedReader {
+	return &rateLimitedReader{
+		reader:      reader,
+		bytesPerSec: bytesPerSec,
+		start:       time.Now(),
+	}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.bytesPerSec {
+		p = p[:r.bytesPerSec]
+	}
+
+	n, err := r.reader.Read(p)
+	r.consumed += n
+	// sleep off the difference between the actual and the budgeted pace
+	expected := time.Duration(r.consumed) * time.Second / time.Duration(r.bytesPerSec)
+	if elapsed := time.Since(r.start); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+
+	return n, err
+}
@@ -1,169 +1,2999 @@
 package logx
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/zeromicro/go-zero/core/fs"
+	"github.com/zeromicro/go-zero/core/lang"
 )
 
+// waitForRotation blocks until logger's async post-rotate work finishes,
+// keeping its goroutines from leaking into later tests that adjust timeNow.
+func waitForRotation(logger *RotateLogger) {
+	for i := 0; i < 100 && atomic.LoadInt32(&logger.rotating) != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func TestDailyRotateRuleMarkRotated(t *testing.T) {
 	var rule DailyRotateRule
 	rule.MarkRotated()
 	assert.Equal(t, getNowDate(), rule.rotatedTime)
 }
 
-func TestDailyRotateRuleOutdatedFiles(t *testing.T) {
-	var rule DailyRotateRule
-	assert.Empty(t, rule.OutdatedFiles())
-	rule.days = 1
-	assert.Empty(t, rule.OutdatedFiles())
-	rule.gzip = true
-	assert.Empty(t, rule.OutdatedFiles())
+func TestDailyRotateRuleOutdatedFiles(t *testing.T) {
+	var rule DailyRotateRule
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.days = 1
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.gzip = true
+	assert.Empty(t, rule.OutdatedFiles())
+}
+
+func TestDailyRotateRuleTimeTagged(t *testing.T) {
+	now := time.Date(2023, time.March, 5, 10, 30, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := DefaultRotateRule("app.log", backupFileDelimiter, 1, false).(*DailyRotateRule)
+	assert.Equal(t, "app.log-2023-03-05", rule.BackupFileName())
+
+	rule.SetTimeTagged(true)
+	first := rule.BackupFileName()
+	assert.Equal(t, "app.log-"+now.Format(rfc3339DateFormat), first)
+
+	// two rotations on the same day get distinct names
+	now = now.Add(time.Hour)
+	assert.NotEqual(t, first, rule.BackupFileName())
+}
+
+func TestDailyRotateRuleOutdatedFilesTimeTagged(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	rule.SetTimeTagged(true)
+
+	// retention handles date-only and time-tagged backups side by side
+	dated := filename + backupFileDelimiter +
+		time.Now().Add(-3*hoursPerDay*time.Hour).Format(dateFormat)
+	tagged := rule.backupFileNameAt(time.Now().Add(-2 * hoursPerDay * time.Hour))
+	fresh := rule.backupFileNameAt(time.Now())
+	for _, file := range []string{dated, tagged, fresh} {
+		assert.Nil(t, os.WriteFile(file, []byte("body"), 0o600))
+	}
+
+	assert.ElementsMatch(t, []string{dated, tagged}, rule.OutdatedFiles())
+}
+
+func TestDailyRotateRuleShallRotate(t *testing.T) {
+	var rule DailyRotateRule
+	rule.rotatedTime = time.Now().Add(time.Hour * 24).Format(dateFormat)
+	assert.True(t, rule.ShallRotate(0, 0))
+}
+
+func TestRotateRuleNonNegativeValues(t *testing.T) {
+	rule := DefaultRotateRule("foo", backupFileDelimiter, -7, false).(*DailyRotateRule)
+	assert.Equal(t, 0, rule.days)
+
+	sizeRule := NewSizeLimitRotateRule("foo", backupFileDelimiter, -7, -100, -10, -5,
+		false).(*SizeLimitRotateRule)
+	assert.Equal(t, 0, sizeRule.days)
+	assert.Equal(t, 0, sizeRule.maxSize)
+	assert.Equal(t, 0, sizeRule.maxBackups)
+	assert.Equal(t, 0, sizeRule.maxTotalSize)
+}
+
+func TestRotateRuleDelimiterFallback(t *testing.T) {
+	// delimiters that would produce unparseable backup names fall back to
+	// the package default instead of poisoning the filenames at runtime
+	rule := DefaultRotateRule("foo", "", -7, false).(*DailyRotateRule)
+	assert.Equal(t, backupFileDelimiter, rule.delimiter)
+
+	sizeRule := NewSizeLimitRotateRule("foo", "T", 1, 1, 1, 0, false).(*SizeLimitRotateRule)
+	assert.Equal(t, backupFileDelimiter, sizeRule.delimiter)
+
+	underscore := NewHourlyRotateRule("foo", "_", 1, false).(*HourlyRotateRule)
+	assert.Equal(t, "_", underscore.delimiter)
+}
+
+func TestNewSizeLimitRotateRuleWithError(t *testing.T) {
+	_, err := NewSizeLimitRotateRuleWithError("foo", "", 1, 1, 1, 0, false)
+	assert.ErrorIs(t, err, ErrEmptyBackupDelimiter)
+
+	_, err = NewSizeLimitRotateRuleWithError("foo", ":", 1, 1, 1, 0, false)
+	assert.Error(t, err)
+
+	rule, err := NewSizeLimitRotateRuleWithError("foo", backupFileDelimiter, 1, 1, 1, 0, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, rule)
+}
+
+type testBackupNamer struct{}
+
+func (testBackupNamer) Name(base string, t time.Time, _ int) string {
+	return fmt.Sprintf("%s_%s", base, t.Format("20060102"))
+}
+
+func (testBackupNamer) Parse(base, name string) (time.Time, int, bool) {
+	prefix := base + "_"
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, 0, false
+	}
+
+	when, err := time.ParseInLocation("20060102", name[len(prefix):], time.Local)
+	return when, 0, err == nil
+}
+
+func TestBackupNamerRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	rule.SetBackupNamer(testBackupNamer{})
+
+	backup := rule.BackupFileName()
+	assert.Equal(t, fmt.Sprintf("%s_%s", filename, time.Now().Format("20060102")), backup)
+
+	outdatedBackup := fmt.Sprintf("%s_%s", filename, time.Now().Add(-72*time.Hour).Format("20060102"))
+	assert.Nil(t, os.WriteFile(outdatedBackup, []byte("old"), 0o600))
+	assert.Nil(t, os.WriteFile(backup, []byte("new"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("x"), 0o600))
+	assert.Equal(t, []string{outdatedBackup}, rule.OutdatedFiles())
+}
+
+func TestDefaultBackupNamers(t *testing.T) {
+	now := time.Now()
+
+	daily := NewDailyBackupNamer(backupFileDelimiter)
+	name := daily.Name("app.log", now, 0)
+	when, _, ok := daily.Parse("app.log", name)
+	assert.True(t, ok)
+	assert.Equal(t, now.Format(dateFormat), when.Format(dateFormat))
+	_, _, ok = daily.Parse("app.log", "app.log")
+	assert.False(t, ok)
+
+	size := NewSizeLimitBackupNamer(backupFileDelimiter)
+	name = size.Name("app.log", now, 0)
+	when, _, ok = size.Parse("app.log", name)
+	assert.True(t, ok)
+	assert.Equal(t, now.Format(rfc3339DateFormat), when.Format(rfc3339DateFormat))
+	_, _, ok = size.Parse("app.log", "app.log")
+	assert.False(t, ok)
+}
+
+func TestTemplateBackupNamer(t *testing.T) {
+	namer, err := NewTemplateBackupNamer(`{{.Prefix}}-{{.Time.Format "20060102"}}{{.Ext}}`)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	name := namer.Name("/var/log/app.log", now, 0)
+	assert.Equal(t, "/var/log/app-"+now.Format("20060102")+".log", name)
+
+	when, _, ok := namer.Parse("/var/log/app.log", name)
+	assert.True(t, ok)
+	assert.Equal(t, now.Format(dateFormat), when.Format(dateFormat))
+	_, _, ok = namer.Parse("/var/log/app.log", "/var/log/app.log")
+	assert.False(t, ok)
+	_, _, ok = namer.Parse("/var/log/app.log", "/var/log/other-20230131.log")
+	assert.False(t, ok)
+
+	// templates that cannot be parsed back are rejected up front
+	_, err = NewTemplateBackupNamer(`{{.Prefix}}{{.Ext}}`)
+	assert.Error(t, err)
+	_, err = NewTemplateBackupNamer(`{{.Time.Format "2006"}}-{{.Time.Format "01"}}`)
+	assert.Error(t, err)
+	_, err = NewTemplateBackupNamer(`{{.Broken`)
+	assert.Error(t, err)
+}
+
+func TestTemplateBackupNamerWithRule(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	namer, err := NewTemplateBackupNamer(`{{.Prefix}}.{{.Time.Format "20060102"}}{{.Ext}}`)
+	assert.Nil(t, err)
+
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	rule.SetBackupNamer(namer)
+	backup := rule.BackupFileName()
+	assert.Equal(t, filepath.Join(dir, "app."+time.Now().Format("20060102")+".log"), backup)
+
+	outdated := namer.Name(filename, time.Now().Add(-72*time.Hour), 0)
+	assert.Nil(t, os.WriteFile(outdated, []byte("old"), 0o600))
+	assert.Nil(t, os.WriteFile(backup, []byte("new"), 0o600))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestTemplateBackupNamerDatedSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	namer, err := NewTemplateBackupNamer(`{{.Time.Format "2006/01/02"}}/{{.Prefix}}{{.Ext}}`)
+	assert.Nil(t, err)
+
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	rule.SetBackupNamer(namer)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// rotation creates the dated subdirectory as needed
+	logger.write([]byte("hello\n"))
+	assert.Nil(t, logger.rotate())
+	waitForRotation(logger)
+	backup := namer.Name(filename, time.Now(), 0)
+	content, err := os.ReadFile(backup)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", string(content))
+
+	// retention walks the tree, finding backups in older dated directories
+	old := time.Now().Add(-72 * time.Hour)
+	outdated := namer.Name(filename, old, 0)
+	assert.Nil(t, os.MkdirAll(filepath.Dir(outdated), 0o755))
+	assert.Nil(t, os.WriteFile(outdated, []byte("old"), 0o600))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestTemplateBackupNamerRelativeFilename(t *testing.T) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	namer, err := NewTemplateBackupNamer(`{{.Prefix}}-{{.Time.Format "20060102"}}{{.Ext}}`)
+	assert.Nil(t, err)
+
+	// a bare relative filename must match the cleaned paths the retention
+	// walk produces, which carry no ./ prefix
+	rule := DefaultRotateRule("app.log", backupFileDelimiter, 1, false).(*DailyRotateRule)
+	rule.SetBackupNamer(namer)
+
+	outdated := namer.Name("app.log", time.Now().Add(-72*time.Hour), 0)
+	backup := namer.Name("app.log", time.Now(), 0)
+	assert.Nil(t, os.WriteFile(outdated, []byte("old"), 0o600))
+	assert.Nil(t, os.WriteFile(backup, []byte("new"), 0o600))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestDailyRotateRuleShallRotateWithClock(t *testing.T) {
+	now := time.Date(2023, time.April, 1, 23, 59, 59, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := DefaultRotateRule("foo", backupFileDelimiter, 1, false).(*DailyRotateRule)
+	assert.False(t, rule.ShallRotate(0, 0))
+	assert.Equal(t, now.Format(rfc3339DateFormat), getNowDateInRFC3339Format())
+
+	// the flip happens exactly on the day change
+	now = now.Add(time.Second)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.Equal(t, "2023-04-02", rule.rotatedTime)
+	assert.False(t, rule.ShallRotate(0, 0))
+}
+
+func TestMonthlyRotateRuleShallRotate(t *testing.T) {
+	now := time.Date(2023, time.January, 31, 23, 59, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := NewMonthlyRotateRule("foo", backupFileDelimiter, 1, false).(*MonthlyRotateRule)
+	assert.Equal(t, "foo"+backupFileDelimiter+"2023-01", rule.BackupFileName())
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// crossing the month boundary
+	now = now.Add(time.Minute)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// crossing the year boundary
+	now = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.Local)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.Equal(t, "2024-01", rule.rotatedTime)
+}
+
+func TestMonthlyRotateRuleOutdatedFiles(t *testing.T) {
+	var rule MonthlyRotateRule
+	// scope the glob to an empty directory, stray files in the working
+	// directory must not interfere
+	rule.filename = filepath.Join(t.TempDir(), "app.log")
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.days = 1
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.gzip = true
+	assert.Empty(t, rule.OutdatedFiles())
+}
+
+func TestMonthlyRotateRuleKeepMonths(t *testing.T) {
+	now := time.Date(2023, time.March, 15, 12, 0, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	dir := t.TempDir()
+	rule := NewMonthlyRotateRule(filepath.Join(dir, "app.log"), backupFileDelimiter,
+		0, false).(*MonthlyRotateRule)
+	assert.Empty(t, rule.OutdatedFiles())
+
+	rule.SetKeepMonths(2)
+	// the boundary walks the calendar, February being short doesn't skew it
+	outdated := rule.backupFileNameAt(time.Date(2022, time.December, 31, 0, 0, 0, 0, time.Local))
+	kept := rule.backupFileNameAt(time.Date(2023, time.January, 1, 0, 0, 0, 0, time.Local))
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Nil(t, os.WriteFile(kept, []byte("x"), 0o644))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+
+	rule.SetKeepMonths(-1)
+	assert.Equal(t, 0, rule.keepMonths)
+}
+
+func TestHourlyRotateRuleShallRotate(t *testing.T) {
+	now := time.Date(2023, time.January, 31, 23, 59, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := NewHourlyRotateRule("foo", backupFileDelimiter, 1, false).(*HourlyRotateRule)
+	assert.Equal(t, "foo"+backupFileDelimiter+"2023-01-31T23", rule.BackupFileName())
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// crossing the hour boundary
+	now = now.Add(time.Minute)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+	assert.Equal(t, "2023-02-01T00", rule.rotatedTime)
+}
+
+func TestHourlyRotateRuleOutdatedFiles(t *testing.T) {
+	var rule HourlyRotateRule
+	// scope the glob to an empty directory, stray files in the working
+	// directory must not interfere
+	rule.filename = filepath.Join(t.TempDir(), "app.log")
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.days = 1
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.gzip = true
+	assert.Empty(t, rule.OutdatedFiles())
+
+	// an hour bucket beyond the keeping window is evicted
+	outdated := rule.backupFileNameAt(time.Now().Add(-2*hoursPerDay*time.Hour)) + gzipExt
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestWeeklyRotateRuleShallRotate(t *testing.T) {
+	now := time.Date(2023, time.February, 5, 23, 59, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := NewWeeklyRotateRule("foo", backupFileDelimiter, 1, false).(*WeeklyRotateRule)
+	assert.Equal(t, "foo"+backupFileDelimiter+"2023-W05", rule.BackupFileName())
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// crossing into the next ISO week
+	now = now.Add(time.Minute)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+	assert.Equal(t, "2023-W06", rule.rotatedTime)
+}
+
+func TestWeeklyRotateRuleOutdatedFiles(t *testing.T) {
+	var rule WeeklyRotateRule
+	// scope the glob to an empty directory, stray files in the working
+	// directory must not interfere
+	rule.filename = filepath.Join(t.TempDir(), "app.log")
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.days = 7
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.gzip = true
+	assert.Empty(t, rule.OutdatedFiles())
+
+	// a week beyond the keeping window is evicted
+	outdated := rule.backupFileNameAt(time.Now().Add(-3*daysPerWeek*hoursPerDay*time.Hour)) + gzipExt
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestRotateRuleCustomCompressedExt(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, true).(*DailyRotateRule)
+	rule.SetCompressedExt(".zip")
+
+	// only the backups carrying the configured extension are matched,
+	// out-of-band .gz files belong to someone else
+	outdated := rule.backupFileNameAt(time.Now().Add(-72*time.Hour)) + ".zip"
+	foreign := rule.backupFileNameAt(time.Now().Add(-96*time.Hour)) + gzipExt
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Nil(t, os.WriteFile(foreign, []byte("x"), 0o644))
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestRotateRuleUTC(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Date(2023, time.February, 1, 2, 0, 0, 0, loc)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := DefaultRotateRule("foo", backupFileDelimiter, 1, false).(*DailyRotateRule)
+	assert.Equal(t, "foo"+backupFileDelimiter+"2023-02-01", rule.BackupFileName())
+
+	// 02:00 on Feb 1st in UTC+8 is still Jan 31st in UTC
+	rule.SetUTC(true)
+	assert.Equal(t, "foo"+backupFileDelimiter+"2023-01-31", rule.BackupFileName())
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// crossing UTC midnight while the local date stays unchanged
+	now = now.Add(6 * time.Hour)
+	assert.True(t, rule.ShallRotate(0, 0))
+}
+
+func TestSizeLimitRotateRuleMarkRotated(t *testing.T) {
+	var rule SizeLimitRotateRule
+	rule.MarkRotated()
+	assert.Equal(t, getNowDateInRFC3339Format(), rule.rotatedTime)
+}
+
+func TestSizeLimitRotateRuleOutdatedFiles(t *testing.T) {
+	var rule SizeLimitRotateRule
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.days = 1
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.gzip = true
+	assert.Empty(t, rule.OutdatedFiles())
+	rule.maxBackups = 0
+	assert.Empty(t, rule.OutdatedFiles())
+}
+
+func TestSizeLimitRotateRuleIgnoresUnrelatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 1, 100, 0, 0,
+		false).(*SizeLimitRotateRule)
+
+	outdated := rule.backupFileNameAt(time.Now().Add(-2 * hoursPerDay * time.Hour))
+	neighbors := []string{
+		filename,
+		filepath.Join(dir, "notes.txt"),
+		filepath.Join(dir, "other.log"),
+	}
+	for _, file := range append(neighbors, outdated) {
+		assert.Nil(t, os.WriteFile(file, []byte("body"), 0o600))
+	}
+
+	// only genuine backups are selected, the neighbors stay untouched
+	assert.Equal(t, []string{outdated}, rule.OutdatedFiles())
+}
+
+func TestSizeLimitRotateRuleShallRotate(t *testing.T) {
+	var rule SizeLimitRotateRule
+	rule.rotatedTime = time.Now().Add(time.Hour * 24).Format(rfc3339DateFormat)
+	rule.maxSize = 0
+	assert.False(t, rule.ShallRotate(0, 0))
+	rule.maxSize = 100
+	assert.False(t, rule.ShallRotate(0, 0))
+	assert.True(t, rule.ShallRotate(99*megabyte, 2*megabyte))
+}
+
+func TestSizeLimitRotateRuleBytes(t *testing.T) {
+	rule := NewSizeLimitRotateRuleBytes("foo", backupFileDelimiter, 1, 10, 0, 0,
+		false).(*SizeLimitRotateRule)
+	assert.False(t, rule.ShallRotate(5, 4))
+	assert.True(t, rule.ShallRotate(5, 6))
+
+	// the byte limit takes precedence over the MB one
+	rule.maxSize = 100
+	assert.True(t, rule.ShallRotate(5, 6))
+
+	negative := NewSizeLimitRotateRuleBytes("foo", backupFileDelimiter, 1, -10, 0, 0,
+		false).(*SizeLimitRotateRule)
+	assert.Equal(t, 0, negative.maxBytes)
+}
+
+func TestSizeLimitRotateRuleKeepHours(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hourly.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 100, 0, 0,
+		false).(*SizeLimitRotateRule)
+	rule.SetKeepHours(2)
+
+	old := rule.backupFileNameAt(time.Now().Add(-3 * time.Hour))
+	fresh := rule.backupFileNameAt(time.Now().Add(-30 * time.Minute))
+	for _, file := range []string{old, fresh} {
+		assert.Nil(t, os.WriteFile(file, []byte("body"), 0o600))
+	}
+
+	assert.Equal(t, []string{old}, rule.OutdatedFiles())
+
+	// the stricter of the keeping days and hours wins
+	rule.days = 1
+	assert.Equal(t, 2, rule.retentionHours())
+	rule.SetKeepHours(48)
+	assert.Equal(t, hoursPerDay, rule.retentionHours())
+}
+
+func TestDailyRotateRuleKeepDuration(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "duration.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 7, false).(*DailyRotateRule)
+	rule.SetKeepDuration(time.Hour * 36)
+
+	// three days old, kept by the 7 keeping days but not by the 36h window
+	old := rule.backupFileNameAt(time.Now().Add(-3 * hoursPerDay * time.Hour))
+	fresh := rule.backupFileNameAt(time.Now().Add(-hoursPerDay * time.Hour))
+	for _, file := range []string{old, fresh} {
+		assert.Nil(t, os.WriteFile(file, []byte("body"), 0o600))
+	}
+
+	// the 36h window overrides the 7 keeping days
+	assert.Equal(t, []string{old}, rule.OutdatedFiles())
+
+	// a negative duration is rejected, the window stays
+	rule.SetKeepDuration(-time.Hour)
+	assert.Equal(t, time.Hour*36, rule.keepDuration)
+}
+
+func TestSizeLimitRotateRuleKeepDuration(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sizedur.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 7, 100, 0, 0,
+		false).(*SizeLimitRotateRule)
+	rule.SetKeepDuration(time.Hour * 3)
+
+	old := rule.backupFileNameAt(time.Now().Add(-4 * time.Hour))
+	fresh := rule.backupFileNameAt(time.Now().Add(-time.Hour))
+	for _, file := range []string{old, fresh} {
+		assert.Nil(t, os.WriteFile(file, []byte("body"), 0o600))
+	}
+
+	assert.Equal(t, 3, rule.retentionHours())
+	assert.Equal(t, []string{old}, rule.OutdatedFiles())
+
+	// the stricter keeping hours still win over the duration
+	rule.SetKeepHours(2)
+	assert.Equal(t, 2, rule.retentionHours())
+}
+
+func TestRotateLoggerSameSecondBackups(t *testing.T) {
+	now := time.Date(2023, time.July, 1, 10, 0, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "burst.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// two rotations within the same second, both backups must survive.
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write(make([]byte, megabyte+1))
+	logger.write(make([]byte, megabyte+1))
+	waitForRotation(logger)
+	files, err := filepath.Glob(rule.(*SizeLimitRotateRule).backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+}
+
+func TestRotateLoggerCopyTruncate(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "copytrunc.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, false)
+	logger, err := NewLogger(filename, rule, false, WithCopyTruncate())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	fp := logger.fp
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("keep me\n"))
+	logger.write(make([]byte, megabyte+1))
+	waitForRotation(logger)
+
+	// the fd survives the rotation, cooperating with external renames
+	assert.Equal(t, fp, logger.fp)
+	files, err := filepath.Glob(rule.(*SizeLimitRotateRule).backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	backup, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "keep me\n", string(backup))
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, megabyte+1, len(content))
+}
+
+func TestRotateLoggerOnError(t *testing.T) {
+	renameErr := errors.New("disk full")
+	osRename = func(_, _ string) error {
+		return renameErr
+	}
+	defer func() {
+		osRename = os.Rename
+	}()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "onerror.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, false)
+	var reported []error
+	logger, err := NewLogger(filename, rule, false, WithOnError(func(err error) {
+		reported = append(reported, err)
+	}))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the rename always fails, so the rotation error must reach the callback.
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("first\n"))
+	logger.write(make([]byte, megabyte+1))
+
+	assert.Equal(t, 1, len(reported))
+	var rotateErr *RotateError
+	assert.True(t, errors.As(reported[0], &rotateErr))
+	assert.Equal(t, filename, rotateErr.Filename)
+	assert.ErrorIs(t, reported[0], renameErr)
+}
+
+func TestRotateLoggerCrossDeviceRename(t *testing.T) {
+	osRename = func(_, _ string) error {
+		return &os.LinkError{Op: "rename", Err: syscall.EXDEV}
+	}
+	defer func() {
+		osRename = os.Rename
+	}()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "xdev.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the rename always fails with EXDEV, rotation must copy the backup instead.
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("survive the mount\n"))
+	logger.write(make([]byte, megabyte+1))
+	waitForRotation(logger)
+
+	files, err := filepath.Glob(rule.(*SizeLimitRotateRule).backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	content, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "survive the mount\n", string(content))
+}
+
+func TestRotateLoggerFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions work differently on windows")
+	}
+
+	dir := filepath.Join(t.TempDir(), "nested")
+	filename := filepath.Join(dir, "perms.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithFileMode(0o640), WithDirMode(0o750))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	info, err := os.Stat(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	info, err = os.Stat(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+
+	// octal strings from the config parse, garbage is rejected
+	mode, err := parseFileMode("0640")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o640), mode)
+	assert.NotNil(t, LogConf{FileMode: "rw-r"}.Validate())
+	assert.NotNil(t, LogConf{DirMode: "rwx"}.Validate())
+}
+
+func TestRotateLoggerCloseCtx(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "closectx.log")
+	rule := &blockedRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowDate(),
+			filename:    filename,
+			delimiter:   backupFileDelimiter,
+		},
+		gate: make(chan lang.PlaceholderType),
+	}
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+
+	// the worker blocks in ShallRotate, simulating a stuck disk
+	_, err = logger.Write([]byte("stuck\n"))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, logger.CloseCtx(ctx), context.Canceled)
+	close(rule.gate)
+}
+
+func TestRotateLoggerFlushInterval(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "durable.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithFlushInterval(time.Millisecond*10))
+	assert.Nil(t, err)
+
+	_, err = logger.Write([]byte("synced\n"))
+	assert.Nil(t, err)
+	// give the sync ticker a few rounds, the worker must survive them
+	time.Sleep(time.Millisecond * 50)
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "synced\n", string(content))
+	assert.Nil(t, logger.Close())
+}
+
+func TestRotateLoggerDropOnFull(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dropfull.log")
+	rule := &blockedRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowDate(),
+			filename:    filename,
+			delimiter:   backupFileDelimiter,
+		},
+		gate: make(chan lang.PlaceholderType),
+	}
+	logger, err := NewLogger(filename, rule, false, WithDropOnFull(), WithBufferSize(1))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the worker blocks in ShallRotate, so later writes hit a full channel
+	// and return immediately instead of blocking
+	for i := 0; i < 5; i++ {
+		_, err = logger.Write([]byte("never block\n"))
+		assert.Nil(t, err)
+	}
+	assert.True(t, atomic.LoadInt64(&logger.stats.dropped) > 0)
+	close(rule.gate)
+}
+
+func TestRotateLoggerPendingCount(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pending.log")
+	rule := &blockedRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowDate(),
+			filename:    filename,
+			delimiter:   backupFileDelimiter,
+		},
+		gate: make(chan lang.PlaceholderType),
+	}
+	logger, err := NewLogger(filename, rule, false, WithBufferSize(8))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 8, logger.Capacity())
+	assert.Equal(t, 0, logger.PendingCount())
+
+	// the worker is stuck in ShallRotate, enqueued writes stay pending
+	for i := 0; i < 3; i++ {
+		_, err = logger.Write([]byte("hello\n"))
+		assert.Nil(t, err)
+	}
+	assert.True(t, logger.PendingCount() >= 2)
+
+	close(rule.gate)
+	assert.Nil(t, logger.Close())
+}
+
+func TestRotateLoggerBufferSize(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "buffered.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithBufferSize(1000))
+	assert.Nil(t, err)
+	defer logger.Close()
+	assert.Equal(t, 1000, cap(logger.channel))
+
+	// non-positive sizes fall back to the default
+	fallback, err := NewLogger(filename, new(DailyRotateRule), false, WithBufferSize(-1))
+	assert.Nil(t, err)
+	defer fallback.Close()
+	assert.Equal(t, bufferSize, cap(fallback.channel))
+}
+
+func TestRotateLoggerCurrentSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a privilege on windows")
+	}
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "linked.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 0, false)
+	logger, err := NewLogger(filename, rule, false, WithCurrentSymlink())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("follow me\n"))
+	assert.Nil(t, err)
+	backup := rule.BackupFileName()
+	_, err = logger.RotateAndCapture()
+	assert.Nil(t, err)
+
+	link := filename + currentLinkExt
+	var target string
+	for i := 0; i < 100; i++ {
+		if target, err = os.Readlink(link); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Base(backup), target)
+
+	// the relative link resolves next to the log file
+	content, err := os.ReadFile(filepath.Join(dir, target))
+	assert.Nil(t, err)
+	assert.Equal(t, "follow me\n", string(content))
+	waitForRotation(logger)
+}
+
+func TestRotateLoggerCurrentSymlinkSubdirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need a privilege on windows")
+	}
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "linked.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithCurrentSymlink())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// a template namer can place backups in dated subdirectories
+	target := filepath.Join(dir, "2022-06", "linked.log.bak")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(target), 0o700))
+	assert.Nil(t, os.WriteFile(target, []byte("nested\n"), 0o600))
+	logger.updateCurrentSymlink(target)
+
+	link, err := os.Readlink(filename + currentLinkExt)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("2022-06", "linked.log.bak"), link)
+	content, err := os.ReadFile(filepath.Join(dir, link))
+	assert.Nil(t, err)
+	assert.Equal(t, "nested\n", string(content))
+}
+
+func TestRotateLoggerCounters(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "counters.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("foo\n"))
+	logger.write(make([]byte, megabyte+1))
+	waitForRotation(logger)
+	assert.Equal(t, int64(megabyte+5), logger.BytesWritten())
+	assert.Equal(t, int64(1), logger.RotationCount())
+	assert.Equal(t, int64(0), logger.DroppedBytes())
+}
+
+func TestRotateLoggerPendingDeletions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	outdated := rule.backupFileNameAt(time.Now().AddDate(0, 0, -2))
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the dry run reports the outdated backup without removing it
+	assert.Equal(t, []string{outdated}, logger.PendingDeletions())
+	_, err = os.Stat(outdated)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerSeedsCurrentSize(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	assert.Nil(t, os.WriteFile(filename, make([]byte, 100), 0o600))
+
+	rule := NewSizeLimitRotateRuleBytes(filename, backupFileDelimiter, 1, 50, 0, 0, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, logger.currentSize)
+
+	// the pre-existing bytes count against the limit, the first write rotates
+	logger.write([]byte("hello\n"))
+	waitForRotation(logger)
+	logger.Close()
+
+	backups, err := filepath.Glob(filepath.Join(dir, "app"+backupFileDelimiter+"*.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backups))
+}
+
+func TestRotateLoggerReopenOnWrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "reopen.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// simulate a rotate that failed to recreate the file, e.g. on a full disk.
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	assert.Nil(t, logger.fp.Close())
+	logger.fp = nil
+	logger.write([]byte("back\n"))
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "back")
+	assert.Equal(t, int64(0), logger.DroppedBytes())
+
+	// an unopenable path counts the dropped bytes instead of losing them silently
+	assert.Nil(t, logger.fp.Close())
+	logger.fp = nil
+	logger.filename = filepath.Join(dir, "missing", "reopen.log")
+	logger.write([]byte("lost\n"))
+	assert.Equal(t, int64(5), logger.DroppedBytes())
+	logger.filename = filename
+}
+
+func TestDailySizeLimitRotateRule(t *testing.T) {
+	now := time.Date(2023, time.May, 10, 12, 0, 0, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "combined.log")
+	rule := NewDailySizeLimitRotateRule(filename, backupFileDelimiter, 1, 1, 0,
+		false).(*DailySizeLimitRotateRule)
+
+	// rotates on size within the day
+	assert.False(t, rule.ShallRotate(0, 100))
+	assert.True(t, rule.ShallRotate(megabyte, megabyte))
+
+	// and on the day boundary regardless of size
+	now = now.Add(12 * time.Hour)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// same-day backups get sequence suffixes
+	first := rule.BackupFileName()
+	assert.Equal(t, filename+backupFileDelimiter+"2023-05-11", first)
+	assert.Nil(t, os.WriteFile(first, []byte("a"), 0o644))
+	second := rule.BackupFileName()
+	assert.Equal(t, first+".1", second)
+	assert.Nil(t, os.WriteFile(second, []byte("b"), 0o644))
+	assert.Equal(t, first+".2", rule.BackupFileName())
+
+	// retention honors both the keeping days and the backup count
+	old := filename + backupFileDelimiter + "2023-05-01"
+	assert.Nil(t, os.WriteFile(old, []byte("c"), 0o644))
+	assert.Equal(t, []string{old}, rule.OutdatedFiles())
+	rule.maxBackups = 1
+	outdated := rule.OutdatedFiles()
+	assert.Contains(t, outdated, old)
+	assert.Contains(t, outdated, first)
+	assert.NotContains(t, outdated, second)
+}
+
+func TestSizeLimitRotateRuleBackupTimestamp(t *testing.T) {
+	// guards against sneaking a skew offset into the timestamp helper:
+	// backup filenames must carry the actual rotation moment, or the
+	// ordering assumptions of OutdatedFiles break
+	var rule SizeLimitRotateRule
+	rule.filename = "app.log"
+	rule.delimiter = backupFileDelimiter
+
+	before := time.Now()
+	name := rule.BackupFileName()
+	after := time.Now()
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, "app"+backupFileDelimiter), ".log")
+	parsed, err := time.Parse(rfc3339DateFormat, stamp)
+	assert.Nil(t, err)
+	assert.False(t, parsed.Before(before.Truncate(time.Second)))
+	assert.False(t, parsed.After(after.Add(time.Second)))
+}
+
+func TestSizeLimitRotateRuleTimestampFormatter(t *testing.T) {
+	now := time.Date(2023, time.June, 15, 10, 30, 45, 0, time.Local)
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := NewSizeLimitRotateRule("app.log", backupFileDelimiter, 1, 100, 10, 0,
+		false).(*SizeLimitRotateRule)
+	rule.SetTimestampFormatter(func(t time.Time) string {
+		return t.UTC().Truncate(time.Minute).Format("2006-01-02T15-04Z")
+	})
+
+	expected := fmt.Sprintf("app%s%s.log", backupFileDelimiter,
+		now.UTC().Truncate(time.Minute).Format("2006-01-02T15-04Z"))
+	assert.Equal(t, expected, rule.BackupFileName())
+	rule.MarkRotated()
+	assert.Equal(t, now.UTC().Truncate(time.Minute).Format("2006-01-02T15-04Z"),
+		rule.rotatedTime)
+}
+
+func TestSizeLimitRotateRuleMaxTotalSize(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "budget.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 100, 0, 1,
+		false).(*SizeLimitRotateRule)
+
+	oldest := rule.backupFileNameAt(time.Now().Add(-3 * time.Hour))
+	middle := rule.backupFileNameAt(time.Now().Add(-2 * time.Hour))
+	newest := rule.backupFileNameAt(time.Now().Add(-time.Hour))
+	payload := make([]byte, 600*1024)
+	for _, file := range []string{oldest, middle, newest} {
+		assert.Nil(t, os.WriteFile(file, payload, 0o600))
+	}
+
+	// newest first: the budget of 1MB is blown on the second 600KB backup
+	assert.ElementsMatch(t, []string{oldest, middle}, rule.OutdatedFiles())
+}
+
+func TestPeriodicSizeLimitRotateRuleShallRotate(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	rule := NewPeriodicSizeLimitRotateRule("foo", backupFileDelimiter, 1, 100, 10,
+		time.Hour, false).(*PeriodicSizeLimitRotateRule)
+	// within the period, only size triggers rotation
+	assert.False(t, rule.ShallRotate(0, 0))
+	assert.True(t, rule.ShallRotate(99*megabyte, 2*megabyte))
+
+	// crossing the hour boundary rotates regardless of size
+	now = now.Add(time.Hour)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+}
+
+func TestNewLoggerValidation(t *testing.T) {
+	_, err := NewLogger("", DefaultRotateRule("foo", backupFileDelimiter, 1, false), false)
+	assert.ErrorIs(t, err, ErrLogPathNotSet)
+
+	_, err = NewLogger(filepath.Join(t.TempDir(), "app.log"), nil, false)
+	assert.ErrorIs(t, err, ErrNilRotateRule)
+}
+
+func TestRotateLoggerClose(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer os.Remove(filename)
+	}
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	assert.Nil(t, logger.Close())
+}
+
+func TestRotateLoggerCloseFlushesChannel(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter,
+		1, false), false)
+	assert.Nil(t, err)
+
+	// close right after enqueueing, none of the accepted lines may be lost
+	for i := 0; i < 100; i++ {
+		_, err = logger.Write([]byte("line\n"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, logger.Close())
+
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, strings.Count(string(content), "line"))
+}
+
+func TestRotateLoggerBatchedWrites(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "batch.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter,
+		0, false), false, WithBatchSize(1024), WithBatchFlush(time.Millisecond*10))
+	assert.Nil(t, err)
+
+	// batching must not lose or merge lines, neither mid-run nor on Close
+	for i := 0; i < 100; i++ {
+		_, err = logger.Write([]byte("batched line\n"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, logger.Close())
+
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, strings.Count(string(content), "batched line\n"))
+	// the lines stat counts messages, not flushed batches
+	assert.Equal(t, int64(100), atomic.LoadInt64(&logger.stats.lines))
+}
+
+func TestRotateLoggerGetBackupFilename(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer os.Remove(filename)
+	}
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	assert.True(t, len(logger.getBackupFilename()) > 0)
+	logger.backup = ""
+	assert.True(t, len(logger.getBackupFilename()) > 0)
+}
+
+type testCompressor struct {
+	ext   string
+	files []string
+}
+
+func (c *testCompressor) Compress(src string) (string, error) {
+	c.files = append(c.files, src)
+	dst := src + c.ext
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func (c *testCompressor) Extension() string {
+	return c.ext
+}
+
+func TestRotateLoggerCompressorSelector(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	small := &testCompressor{ext: ".small"}
+	large := &testCompressor{ext: ".large"}
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), true,
+		WithCompressorSelector(func(size int64) Compressor {
+			if size > 10 {
+				return large
+			}
+			return small
+		}))
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+	}()
+
+	smallFile, err := fs.TempFilenameWithText("tiny")
+	assert.Nil(t, err)
+	defer os.Remove(smallFile + ".small")
+	largeFile, err := fs.TempFilenameWithText(strings.Repeat("x", 100))
+	assert.Nil(t, err)
+	defer os.Remove(largeFile + ".large")
+
+	logger.maybeCompressFile(smallFile)
+	logger.maybeCompressFile(largeFile)
+	assert.Equal(t, []string{smallFile}, small.files)
+	assert.Equal(t, []string{largeFile}, large.files)
+}
+
+type slowCompressor struct {
+	started chan lang.PlaceholderType
+	release chan lang.PlaceholderType
+}
+
+func (c *slowCompressor) Compress(src string) (string, error) {
+	close(c.started)
+	<-c.release
+	dst := src + c.Extension()
+	return dst, os.Rename(src, dst)
+}
+
+func (c *slowCompressor) Extension() string {
+	return ".slow"
+}
+
+func TestRotateLoggerSkipsInFlightCompressions(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	backup := rule.backupFileNameAt(time.Now().Add(-72 * time.Hour))
+	assert.Nil(t, os.WriteFile(backup, []byte("old"), 0o600))
+
+	compressor := &slowCompressor{
+		started: make(chan lang.PlaceholderType),
+		release: make(chan lang.PlaceholderType),
+	}
+	logger, err := NewLogger(filename, rule, true, WithCompressor(compressor))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	done := make(chan lang.PlaceholderType)
+	go func() {
+		logger.maybeCompressFile(backup)
+		close(done)
+	}()
+	<-compressor.started
+
+	// the sweep sees the backup as outdated, but must leave it alone while
+	// the compressor is still writing it
+	logger.maybeDeleteOutdatedFiles()
+	_, err = os.Stat(backup)
+	assert.Nil(t, err)
+
+	close(compressor.release)
+	<-done
+	assert.False(t, logger.isInFlight(backup))
+}
+
+func TestRotateLoggerKeepUncompressed(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "recent.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, true)
+	logger, err := NewLogger(filename, rule, true, WithKeepUncompressed(1))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	namer := rule.(backupTimeNamer)
+	older := namer.backupFileNameAt(time.Now().Add(-2 * time.Hour))
+	newest := namer.backupFileNameAt(time.Now().Add(-time.Hour))
+	for _, file := range []string{older, newest} {
+		assert.Nil(t, os.WriteFile(file, []byte("content"), 0o600))
+	}
+
+	logger.compressAgedBackups()
+
+	// the older backup is compressed, the newest stays plain
+	_, err = os.Stat(older + ".gz")
+	assert.Nil(t, err)
+	_, err = os.Stat(older)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(newest)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerScheduledCleanup(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sweep.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	outdated := filename + backupFileDelimiter +
+		time.Now().Add(-3*hoursPerDay*time.Hour).Format(dateFormat)
+	assert.Nil(t, os.WriteFile(outdated, []byte("old"), 0o600))
+
+	logger, err := NewLogger(filename, rule, false,
+		WithCleanupInterval(time.Millisecond*20))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// no rotation ever happens, the scheduled sweep must delete the backup
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(outdated); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("outdated backup %s not cleaned up", outdated)
+}
+
+func TestRotateLoggerOnDelete(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ondelete.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	outdated := filename + backupFileDelimiter +
+		time.Now().Add(-3*hoursPerDay*time.Hour).Format(dateFormat)
+	assert.Nil(t, os.WriteFile(outdated, []byte("old content"), 0o600))
+
+	type deletion struct {
+		file string
+		size int64
+		err  error
+	}
+	events := make(chan deletion, 1)
+	logger, err := NewLogger(filename, rule, false,
+		WithCleanupInterval(time.Millisecond*20),
+		WithOnDelete(func(file string, size int64, err error) {
+			events <- deletion{file: file, size: size, err: err}
+		}))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	select {
+	case event := <-events:
+		assert.Equal(t, outdated, event.file)
+		assert.Equal(t, int64(len("old content")), event.size)
+		assert.Nil(t, event.err)
+		_, err = os.Stat(outdated)
+		assert.True(t, os.IsNotExist(err))
+	case <-time.After(time.Second * 5):
+		t.Fatal("OnDelete callback not invoked")
+	}
+}
+
+func TestRotateLoggerRotateCheckInterval(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "idle.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 0, false).(*DailyRotateRule)
+	// pretend the last rotation happened yesterday, the boundary passed
+	rule.rotatedTime = time.Now().Add(-hoursPerDay * time.Hour).Format(dateFormat)
+
+	logger, err := NewLogger(filename, rule, false,
+		WithRotateCheckInterval(time.Millisecond*20))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// no write ever happens, the timer alone must drive the rotation
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(&logger.stats.rotations) > 0 {
+			waitForRotation(logger)
+			files, err := filepath.Glob(rule.backupPattern(false))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(files))
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("idle rotation not triggered by the timer")
+}
+
+func TestRotateLoggerLegacyCompression(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "legacy.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 1, 0, 0, true)
+
+	// backups from before compression was enabled, left uncompressed
+	namer := rule.(backupTimeNamer)
+	older := namer.backupFileNameAt(time.Now().Add(-2 * time.Hour))
+	newer := namer.backupFileNameAt(time.Now().Add(-time.Hour))
+	for _, file := range []string{older, newer} {
+		assert.Nil(t, os.WriteFile(file, []byte("legacy content"), 0o600))
+	}
+
+	logger, err := NewLogger(filename, rule, true, WithLegacyCompression())
+	assert.Nil(t, err)
+	defer logger.Close()
+	waitForRotation(logger)
+
+	for _, file := range []string{older, newer} {
+		_, err = os.Stat(file + ".gz")
+		assert.Nil(t, err)
+		_, err = os.Stat(file)
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestRotateLoggerMayCompressFile(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer os.Remove(filename)
+	}
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	logger.maybeCompressFile(filename)
+	_, err = os.Stat(filename)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerMayCompressFileTrue(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), true)
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
+	}
+	logger.maybeCompressFile(filename)
+	_, err = os.Stat(filename)
+	assert.NotNil(t, err)
+}
+
+func TestGzipFileConflict(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.log")
+	assert.Nil(t, os.WriteFile(file, []byte("fresh"), 0o600))
+	assert.Nil(t, os.WriteFile(file+gzipExt, []byte("prior archive"), 0o600))
+	buf := make([]byte, defaultCopyBufferSize)
+
+	// the prior archive is kept, the new one gets a unique name
+	assert.Nil(t, gzipFile(file, buf, CompressConflictRename, 0, gzip.DefaultCompression))
+	content, err := os.ReadFile(file + gzipExt)
+	assert.Nil(t, err)
+	assert.Equal(t, "prior archive", string(content))
+	// the sequence sits before the filename extension, keeping the renamed
+	// archive visible to the backup patterns of the rules
+	_, err = os.Stat(filepath.Join(dir, "app.1.log"+gzipExt))
+	assert.Nil(t, err)
+
+	// with skip policy, the plain file stays and the archive is untouched
+	assert.Nil(t, os.WriteFile(file, []byte("fresh"), 0o600))
+	assert.Nil(t, gzipFile(file, buf, CompressConflictSkip, 0, gzip.DefaultCompression))
+	_, err = os.Stat(file)
+	assert.Nil(t, err)
+	content, err = os.ReadFile(file + gzipExt)
+	assert.Nil(t, err)
+	assert.Equal(t, "prior archive", string(content))
+}
+
+func TestRotateLoggerRotate(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), true)
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer func() {
+			os.Remove(logger.getBackupFilename())
+			os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
+		}()
+	}
+	err = logger.rotate()
+	switch v := err.(type) {
+	case *os.LinkError:
+		// avoid rename error on docker container
+		assert.Equal(t, syscall.EXDEV, v.Err)
+	case *os.PathError:
+		// ignore remove error for tests,
+		// files are cleaned in GitHub actions.
+		assert.Equal(t, "remove", v.Op)
+	default:
+		assert.Nil(t, err)
+	}
+}
+
+func TestRotateLoggerRotateMissingFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the active file vanished, there is nothing to seal as a backup
+	assert.Nil(t, os.Remove(filename))
+	assert.Nil(t, logger.rotate())
+
+	backups, err := filepath.Glob(filename + backupFileDelimiter + "*")
+	assert.Nil(t, err)
+	assert.Empty(t, backups)
+	_, err = os.Stat(filename)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerRecreateOnMissing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unlinking an open file is not supported on windows")
+	}
+
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithRecreateOnMissing())
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+	}()
+
+	assert.Nil(t, os.Remove(filename))
+	// the following calls cannot race with Write, same as the write calls below.
+	logger.maybeRecreateFile()
+	_, err = os.Stat(filename)
+	assert.Nil(t, err)
+	logger.write([]byte(`foo`))
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", string(content))
+}
+
+func TestRotateLoggerBackgroundConcurrency(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), true, WithBackgroundConcurrency(1))
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+	}()
+
+	target, err := fs.TempFilenameWithText("bar")
+	assert.Nil(t, err)
+	defer os.Remove(target + gzipExt)
+
+	// occupy the only background slot, the compression must wait for it
+	logger.bgWorkers <- lang.Placeholder
+	logger.postRotate(target)
+	time.Sleep(50 * time.Millisecond)
+	_, err = os.Stat(target)
+	assert.Nil(t, err)
+
+	// release the slot and wait for the compression to finish
+	<-logger.bgWorkers
+	for i := 0; i < 100 && logger.Rotating(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = os.Stat(target)
+	assert.NotNil(t, err)
+}
+
+func TestRotateLoggerPruneEmptyBackups(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	emptyBackup := filename + backupFileDelimiter + "2023-01-01"
+	filledBackup := filename + backupFileDelimiter + "2023-01-02"
+	assert.Nil(t, os.WriteFile(emptyBackup, nil, 0o600))
+	assert.Nil(t, os.WriteFile(filledBackup, []byte("foo"), 0o600))
+
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, false),
+		false, WithPruneEmptyBackups())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	logger.maybeDeleteOutdatedFiles()
+	_, err = os.Stat(emptyBackup)
+	assert.NotNil(t, err)
+	_, err = os.Stat(filledBackup)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerMemoryBuffer(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithMemoryBuffer(1024, 10*time.Millisecond))
+	assert.Nil(t, err)
+	defer os.Remove(filename)
+
+	_, err = logger.Write([]byte("foo\n"))
+	assert.Nil(t, err)
+	// wait for the flush interval to kick in
+	var content []byte
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if content, err = os.ReadFile(filename); err == nil && len(content) > 0 {
+			break
+		}
+	}
+	assert.Equal(t, "foo\n", string(content))
+
+	assert.Nil(t, logger.Close())
+
+	// a long interval, the remaining buffer is only flushed on Close
+	logger, err = NewLogger(filename, new(DailyRotateRule), false,
+		WithMemoryBuffer(1024, time.Hour))
+	assert.Nil(t, err)
+	_, err = logger.Write([]byte("bar\n"))
+	assert.Nil(t, err)
+	// give the worker a chance to move the event into the buffer
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, logger.Close())
+	content, err = os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo\nbar\n", string(content))
+}
+
+func TestRotateLoggerLazyRetry(t *testing.T) {
+	dir := t.TempDir()
+	blocker := filepath.Join(dir, "sub")
+	// a regular file blocks the creation of the log directory
+	assert.Nil(t, os.WriteFile(blocker, []byte("x"), 0o600))
+	filename := filepath.Join(blocker, "app.log")
+
+	logger, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithLazyRetry(10*time.Millisecond))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("foo\n"))
+	assert.Nil(t, err)
+
+	// make the path available, buffered logs land once it's writable
+	assert.Nil(t, os.Remove(blocker))
+	var content []byte
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if content, err = os.ReadFile(filename); err == nil && len(content) > 0 {
+			break
+		}
+	}
+	assert.Equal(t, "foo\n", string(content))
+}
+
+func TestRotateLoggerWriteBackupTo(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	plain := filepath.Join(dir, "plain.log")
+	assert.Nil(t, os.WriteFile(plain, []byte("plain content"), 0o600))
+	compressed := filepath.Join(dir, "compressed.log")
+	assert.Nil(t, os.WriteFile(compressed, []byte("compressed content"), 0o600))
+	assert.Nil(t, gzipFile(compressed, make([]byte, defaultCopyBufferSize), CompressConflictRename, 0, gzip.DefaultCompression))
+
+	var buf bytes.Buffer
+	assert.Nil(t, logger.WriteBackupTo(plain, &buf))
+	assert.Equal(t, "plain content", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, logger.WriteBackupTo(compressed+gzipExt, &buf))
+	assert.Equal(t, "compressed content", buf.String())
+
+	assert.NotNil(t, logger.WriteBackupTo(filepath.Join(dir, "missing.log"), &buf))
+}
+
+func TestRotateLoggerDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	assert.Nil(t, os.WriteFile(filename, []byte("foo"), 0o600))
+	assert.Nil(t, os.WriteFile(filename+backupFileDelimiter+"2023-01-01", []byte("fourch"), 0o600))
+	assert.Nil(t, os.WriteFile(filename+backupFileDelimiter+"2023-01-02"+gzipExt,
+		[]byte("f"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("xxxx"), 0o600))
+
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 1, false),
+		false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	usage, err := logger.DiskUsage()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), usage)
+}
+
+func TestRotateLoggerCloseSummary(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer os.Remove(filename)
+	}
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithCloseSummary())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte(`foo`))
+	logger.write([]byte(`bar`))
+	atomic.AddInt64(&logger.stats.dropped, 1)
+	summary := logger.summary()
+	assert.Contains(t, summary, "lines: 2")
+	assert.Contains(t, summary, "bytes: 6")
+	assert.Contains(t, summary, "rotations: 0")
+	assert.Contains(t, summary, "dropped: 1")
+}
+
+func TestRotateLoggerRotateTriggerFile(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	trigger, err := fs.TempFilenameWithText("")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithRotateTriggerFile(trigger))
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+		os.Remove(logger.getBackupFilename())
+	}()
+
+	backup := logger.getBackupFilename()
+	// the following call cannot race with Write, same as the write calls below.
+	logger.maybeRotateOnTrigger()
+	_, err = os.Stat(backup)
+	assert.Nil(t, err)
+	_, err = os.Stat(trigger)
+	assert.NotNil(t, err)
+}
+
+func TestRotateLoggerStreamingGzip(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithStreamingGzip())
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+	}()
+
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("streaming\n"))
+
+	// read a complete line back while the logger is still writing
+	f, err := os.Open(filename)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	line, err := bufio.NewReader(r).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "streaming\n", line)
+}
+
+func TestRotateLoggerRotating(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+		os.Remove(logger.getBackupFilename())
+	}()
+
+	assert.False(t, logger.Rotating())
+	assert.Nil(t, logger.rotate())
+	// wait for the background post-rotate work to finish
+	for i := 0; i < 100 && logger.Rotating(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.False(t, logger.Rotating())
+	atomic.AddInt32(&logger.rotating, 1)
+	assert.True(t, logger.Rotating())
+	atomic.AddInt32(&logger.rotating, -1)
+	assert.False(t, logger.Rotating())
+}
+
+func TestRotateLoggerWrite(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	rule := new(DailyRotateRule)
+	logger, err := NewLogger(filename, rule, true)
+	assert.Nil(t, err)
+	if len(filename) > 0 {
+		defer func() {
+			os.Remove(logger.getBackupFilename())
+			os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
+		}()
+	}
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte(`foo`))
+	rule.rotatedTime = time.Now().Add(-time.Hour * 24).Format(dateFormat)
+	logger.write([]byte(`bar`))
+	logger.Close()
+	logger.write([]byte(`baz`))
+}
+
+func TestRotateLoggerPauseResume(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("foo")
+	assert.Nil(t, err)
+	rule := new(DailyRotateRule)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer func() {
+		logger.Close()
+		os.Remove(filename)
+		os.Remove(logger.getBackupFilename())
+	}()
+
+	backup := logger.getBackupFilename()
+	logger.Pause()
+	rule.rotatedTime = time.Now().Add(-time.Hour * 24).Format(dateFormat)
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte(`foo`))
+	logger.write([]byte(`bar`))
+	_, err = os.Stat(backup)
+	assert.NotNil(t, err)
+
+	logger.Resume()
+	logger.write([]byte(`baz`))
+	_, err = os.Stat(backup)
+	assert.Nil(t, err)
+}
+
+func TestRotateLoggerFileTrailer(t *testing.T) {
+	filename, err := fs.TempFilenameWithText("")
+	assert.Nil(t, err)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithFileTrailer(func() []byte {
+			return []byte("### EOF\n")
+		}))
+	assert.Nil(t, err)
+	backup := logger.getBackupFilename()
+	defer func() {
+		os.Remove(filename)
+		os.Remove(backup)
+	}()
+
+	// the following calls cannot race with Write, same as the write calls below.
+	logger.write([]byte("foo\n"))
+	assert.Nil(t, logger.rotate())
+	content, err := os.ReadFile(backup)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(content), "### EOF\n"))
+
+	logger.write([]byte("bar\n"))
+	assert.Nil(t, logger.Close())
+	content, err = os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar\n### EOF\n", string(content))
+}
+
+type concurrencyTrackingWriter struct {
+	current int32
+	max     int32
+}
+
+func (w *concurrencyTrackingWriter) Write(p []byte) (int, error) {
+	cur := atomic.AddInt32(&w.current, 1)
+	for {
+		max := atomic.LoadInt32(&w.max)
+		if cur <= max || atomic.CompareAndSwapInt32(&w.max, max, cur) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	atomic.AddInt32(&w.current, -1)
+	return len(p), nil
+}
+
+func TestRotateLoggerMaxBackupStreams(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	backup := filepath.Join(dir, "app.log.backup")
+	assert.Nil(t, os.WriteFile(backup, []byte("backup content"), 0o600))
+
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithMaxBackupStreams(2))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	tracker := new(concurrencyTrackingWriter)
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			assert.Nil(t, logger.WriteBackupTo(backup, tracker))
+		}()
+	}
+	group.Wait()
+
+	assert.True(t, atomic.LoadInt32(&tracker.max) <= 2, "max concurrent streams: %d",
+		tracker.max)
+}
+
+func TestRotateLoggerCompressSkipRatio(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "mixed.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), true,
+		WithCompressSkipRatio(0.9))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	incompressible := filepath.Join(dir, "blob.log")
+	random := make([]byte, 8192)
+	_, err = rand.Read(random)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(incompressible, random, 0o600))
+
+	compressible := filepath.Join(dir, "text.log")
+	assert.Nil(t, os.WriteFile(compressible, []byte(strings.Repeat("all work and no play\n",
+		400)), 0o600))
+
+	// cannot be changed to Write, because of DATA RACE.
+	logger.maybeCompressFile(incompressible)
+	logger.maybeCompressFile(compressible)
+
+	assert.FileExists(t, incompressible)
+	assert.NoFileExists(t, incompressible+gzipExt)
+	assert.NoFileExists(t, compressible)
+	assert.FileExists(t, compressible+gzipExt)
+}
+
+func TestRotateLoggerOverlapDetection(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "overlap.log")
+	first, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithOverlapDetection(time.Millisecond*100))
+	assert.Nil(t, err)
+
+	// the overlap window: the old writer still holds the file
+	_, err = NewLogger(filename, new(DailyRotateRule), false,
+		WithOverlapDetection(time.Millisecond*100))
+	assert.Equal(t, ErrActiveWriter, err)
+
+	// once the old writer lets go, the new one takes over
+	assert.Nil(t, first.Close())
+	second, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithOverlapDetection(time.Millisecond*100))
+	assert.Nil(t, err)
+	assert.Nil(t, second.Close())
+	assert.NoFileExists(t, filename+writerMarkerExt)
+
+	// a marker left behind by a dead process is taken over
+	assert.Nil(t, os.WriteFile(filename+writerMarkerExt, []byte("1073741824"), 0o600))
+	third, err := NewLogger(filename, new(DailyRotateRule), false,
+		WithOverlapDetection(time.Millisecond*100))
+	assert.Nil(t, err)
+	assert.Nil(t, third.Close())
+}
+
+func TestRotateLoggerExclusiveLock(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "excl.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithExclusiveLock())
+	assert.Nil(t, err)
+
+	// the lock holder blocks a second exclusive writer on the same file
+	_, err = NewLogger(filename, new(DailyRotateRule), false, WithExclusiveLock())
+	assert.ErrorIs(t, err, ErrExclusiveLock)
+
+	// the lock is opt-in, a non-exclusive writer is not stopped
+	loose, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	assert.Nil(t, loose.Close())
+
+	// closing releases the lock along with the file
+	assert.Nil(t, logger.Close())
+	second, err := NewLogger(filename, new(DailyRotateRule), false, WithExclusiveLock())
+	assert.Nil(t, err)
+	assert.Nil(t, second.Close())
+}
+
+func TestRotateRuleRetentionDebug(t *testing.T) {
+	var buf bytes.Buffer
+	prev := writer.Swap(NewWriter(&buf))
+	defer writer.Swap(prev)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	overCount := filepath.Join(dir, fmt.Sprintf("app%s%s.log", backupFileDelimiter,
+		time.Now().Add(-time.Hour*hoursPerDay*5).Format(rfc3339DateFormat)))
+	outdated := filepath.Join(dir, fmt.Sprintf("app%s%s.log", backupFileDelimiter,
+		time.Now().Add(-time.Hour*hoursPerDay*3).Format(rfc3339DateFormat)))
+	recent := filepath.Join(dir, fmt.Sprintf("app%s%s.log", backupFileDelimiter,
+		time.Now().Format(rfc3339DateFormat)))
+	for _, file := range []string{overCount, outdated, recent} {
+		assert.Nil(t, os.WriteFile(file, []byte("x"), 0o600))
+	}
+
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 1, 100, 2, 0,
+		false).(*SizeLimitRotateRule)
+	rule.SetRetentionDebug(true)
+	assert.ElementsMatch(t, []string{overCount, outdated}, rule.OutdatedFiles())
+
+	output := buf.String()
+	assert.Contains(t, output, fmt.Sprintf("retention: evicting %s, over 2 max backups",
+		overCount))
+	assert.Contains(t, output, fmt.Sprintf("retention: evicting %s, older than 1 days",
+		outdated))
+	assert.Contains(t, output, fmt.Sprintf("retention: keeping %s and newer, within 1 days",
+		recent))
+}
+
+func TestRotateLoggerRotateGuard(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "guarded.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 1, 1, 10, 0,
+		false).(*SizeLimitRotateRule)
+	var allow int32
+	logger, err := NewLogger(filename, rule, false, WithRotateGuard(func() bool {
+		return atomic.LoadInt32(&allow) != 0
+	}))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the following calls cannot be changed to Write, because of DATA RACE.
+	logger.currentSize = 2 * megabyte
+	logger.write([]byte("guarded\n"))
+	assert.True(t, logger.currentSize > 2*megabyte)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&logger.stats.rotations))
+
+	atomic.StoreInt32(&allow, 1)
+	logger.write([]byte("released\n"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&logger.stats.rotations))
+}
+
+func TestGzipFileIORate(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	file := filepath.Join(t.TempDir(), "throttled.log")
+	assert.Nil(t, os.WriteFile(file, make([]byte, 2048), 0o600))
+
+	// 2048 bytes at 4096 bytes/s takes about half a second
+	start := time.Now()
+	assert.Nil(t, gzipFile(file, make([]byte, 512), CompressConflictRename, 4096, gzip.DefaultCompression))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Millisecond*400, "compression took %s", elapsed)
+	assert.FileExists(t, file+gzipExt)
+}
+
+func TestRotateLoggerRetentionOnlyRule(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	older := filepath.Join(dir, "app-2023-01-01T00:00:00+08:00.log")
+	newer := filepath.Join(dir, "app-2023-01-02T00:00:00+08:00.log")
+	assert.Nil(t, os.WriteFile(older, []byte("older"), 0o600))
+	assert.Nil(t, os.WriteFile(newer, []byte("newer"), 0o600))
+
+	rule := NewRetentionOnlyRotateRule(filename, backupFileDelimiter, 0, 1, false)
+	logger, err := NewLogger(filename, rule, false,
+		WithCleanupInterval(time.Millisecond*10))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("keep writing the same file\n"))
+	assert.Nil(t, err)
+
+	// the cleanup timer prunes the excess sibling, the active file never rotates
+	for i := 0; i < 300; i++ {
+		if _, err := os.Stat(older); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.NoFileExists(t, older)
+	assert.FileExists(t, newer)
+	assert.FileExists(t, filename)
+	assert.False(t, rule.ShallRotate(megabyte, megabyte))
+}
+
+func TestRotateRuleBackupQualifier(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	first := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	second := DefaultRotateRule(filename, backupFileDelimiter, 1, false).(*DailyRotateRule)
+	first.SetBackupQualifier("pod-a")
+	second.SetBackupQualifier("pod-b")
+
+	// both replicas rotate on the same day without colliding
+	assert.NotEqual(t, first.BackupFileName(), second.BackupFileName())
+
+	// retention only matches the replica's own backups
+	outdated := time.Now().Add(-time.Hour * hoursPerDay * 3).Format(dateFormat)
+	firstBackup := fmt.Sprintf("%s%spod-a%s%s", filename, backupFileDelimiter,
+		backupFileDelimiter, outdated)
+	secondBackup := fmt.Sprintf("%s%spod-b%s%s", filename, backupFileDelimiter,
+		backupFileDelimiter, outdated)
+	assert.Nil(t, os.WriteFile(firstBackup, []byte("a"), 0o600))
+	assert.Nil(t, os.WriteFile(secondBackup, []byte("b"), 0o600))
+	assert.Equal(t, []string{firstBackup}, first.OutdatedFiles())
+	assert.Equal(t, []string{secondBackup}, second.OutdatedFiles())
+}
+
+func TestRotateLoggerCompressOnClose(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	filename := filepath.Join(t.TempDir(), "job.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, true)
+	logger, err := NewLogger(filename, rule, true, WithCompressOnClose())
+	assert.Nil(t, err)
+
+	_, err = logger.Write([]byte("short job output\n"))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 50)
+	assert.Nil(t, logger.Close())
+
+	var buf bytes.Buffer
+	assert.Nil(t, logger.WriteBackupTo(rule.BackupFileName()+gzipExt, &buf))
+	assert.Equal(t, "short job output\n", buf.String())
+	assert.NoFileExists(t, filename)
+}
+
+func TestRotateLoggerImportExisting(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 2, false),
+		false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	recent := filepath.Join(dir, "legacy1.log")
+	stale := filepath.Join(dir, "legacy2.log")
+	assert.Nil(t, os.WriteFile(recent, []byte("recent\n"), 0o600))
+	assert.Nil(t, os.WriteFile(stale, []byte("stale\n"), 0o600))
+	yesterday := time.Now().Add(-time.Hour * hoursPerDay)
+	lastWeek := time.Now().Add(-time.Hour * hoursPerDay * 5)
+	assert.Nil(t, os.Chtimes(recent, yesterday, yesterday))
+	assert.Nil(t, os.Chtimes(stale, lastWeek, lastWeek))
+
+	assert.Nil(t, logger.ImportExisting(dir, "legacy*.log"))
+
+	// legacy files are renamed into the backup scheme, outdated ones removed
+	assert.NoFileExists(t, recent)
+	assert.NoFileExists(t, stale)
+	content, err := os.ReadFile(fmt.Sprintf("%s%s%s", filename, backupFileDelimiter,
+		yesterday.Format(dateFormat)))
+	assert.Nil(t, err)
+	assert.Equal(t, "recent\n", string(content))
+	assert.NoFileExists(t, fmt.Sprintf("%s%s%s", filename, backupFileDelimiter,
+		lastWeek.Format(dateFormat)))
+}
+
+func TestRotateLoggerExtraOpenFlags(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sync.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 1, false),
+		false, WithExtraOpenFlags(os.O_SYNC|os.O_RDWR))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// access mode bits must be stripped, only the sync flag remains
+	assert.Equal(t, os.O_SYNC, logger.extraFlags)
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, logger.fp.Fd(),
+		uintptr(syscall.F_GETFL), 0)
+	assert.Equal(t, syscall.Errno(0), errno)
+	assert.Equal(t, syscall.O_SYNC, int(flags)&syscall.O_SYNC)
+}
+
+func TestRotateLoggerRotateAndCapture(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "capture.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("first line\n"))
+	assert.Nil(t, err)
+	_, err = logger.Write([]byte("second line\n"))
+	assert.Nil(t, err)
+
+	data, err := logger.RotateAndCapture()
+	assert.Nil(t, err)
+	assert.Equal(t, "first line\nsecond line\n", string(data))
+
+	// the sealed backup holds the captured content, the active file restarts empty
+	backup, err := os.ReadFile(rule.BackupFileName())
+	assert.Nil(t, err)
+	assert.Equal(t, data, backup)
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Empty(t, content)
+	waitForRotation(logger)
+}
+
+func TestRotateLoggerForcedRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "forced.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+
+	_, err = logger.Write([]byte("before the cut\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, logger.Rotate())
+
+	// the sealed backup holds the accepted writes, the active file restarts empty
+	backup, err := os.ReadFile(rule.BackupFileName())
+	assert.Nil(t, err)
+	assert.Equal(t, "before the cut\n", string(backup))
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Empty(t, content)
+	waitForRotation(logger)
+
+	assert.Nil(t, logger.Close())
+	assert.ErrorIs(t, logger.Rotate(), ErrLogFileClosed)
+}
+
+func TestRotateLoggerProtectFreshBackup(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "fresh.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 0, 100, 1, 0,
+		false).(*SizeLimitRotateRule)
+
+	// a stray future-named backup sorts newer than the fresh one, making the
+	// fresh backup the eviction candidate under maxBackups of 1
+	future := rule.backupFileNameAt(time.Now().Add(time.Hour))
+	assert.Nil(t, os.WriteFile(future, []byte("future"), 0o600))
+
+	logger, err := NewLogger(filename, rule, false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("preserve me\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, logger.Rotate())
+	waitForRotation(logger)
+
+	// the just-sealed backup survives the immediate sweep
+	files, err := filepath.Glob(rule.backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(files))
+	for _, file := range files {
+		if file == future {
+			continue
+		}
+		content, err := os.ReadFile(file)
+		assert.Nil(t, err)
+		assert.Equal(t, "preserve me\n", string(content))
+	}
+}
+
+func TestRotateLoggerRotationMarker(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "marker.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false, WithMarkerOnRotate())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("before the cut\n"))
+	assert.Nil(t, err)
+	backup := rule.BackupFileName()
+	assert.Nil(t, logger.Rotate())
+	waitForRotation(logger)
+
+	// the fresh file opens with the marker, the backup stays marker-free
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	var marker map[string]string
+	assert.Nil(t, json.Unmarshal(content, &marker))
+	assert.Equal(t, fmt.Sprintf("%s->%s", backup, filename), marker[rotatedKey])
+	assert.NotEmpty(t, marker[timestampKey])
+	sealed, err := os.ReadFile(backup)
+	assert.Nil(t, err)
+	assert.Equal(t, "before the cut\n", string(sealed))
+}
+
+func TestRotateLoggerRotationMarkerPlain(t *testing.T) {
+	old := atomic.LoadUint32(&encoding)
+	atomic.StoreUint32(&encoding, plainEncodingType)
+	defer atomic.StoreUint32(&encoding, old)
+
+	filename := filepath.Join(t.TempDir(), "plainmarker.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false, WithMarkerOnRotate())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("before the cut\n"))
+	assert.Nil(t, err)
+	backup := rule.BackupFileName()
+	assert.Nil(t, logger.Rotate())
+	waitForRotation(logger)
+
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	fields := strings.Split(strings.TrimSuffix(string(content), "\n"),
+		string(plainEncodingSep))
+	assert.Equal(t, 3, len(fields))
+	assert.Equal(t, rotatedKey, fields[1])
+	assert.Equal(t, fmt.Sprintf("%s->%s", backup, filename), fields[2])
+}
+
+func TestRotateLoggerRuleFilenameMismatch(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	other := filepath.Join(dir, "other.log")
+
+	// a rule built for another base name would glob backups the logger
+	// never creates
+	_, err := NewLogger(filename, DefaultRotateRule(other, backupFileDelimiter, 0, false), false)
+	assert.ErrorIs(t, err, ErrRuleFilenameMismatch)
+
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, false), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	assert.ErrorIs(t, logger.SetRule(NewSizeLimitRotateRule(other, backupFileDelimiter,
+		0, 1, 0, 0, false)), ErrRuleFilenameMismatch)
+
+	// an unclean path spelling of the same file is not a mismatch
+	uncleaned := filepath.Join(dir, ".", "app.log")
+	assert.Nil(t, checkRuleFilename(DefaultRotateRule(uncleaned, backupFileDelimiter,
+		0, false), filename))
+}
+
+func TestRotateLoggerSynchronousWrites(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	rule := NewSizeLimitRotateRuleBytes(filename, backupFileDelimiter, 0, 32, 3, 0,
+		false).(*SizeLimitRotateRule)
+	logger, err := NewLogger(filename, rule, false, WithSynchronousWrites())
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the line is on disk the moment Write returns, no worker involved
+	n, err := logger.Write([]byte("audit line one\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, len("audit line one\n"), n)
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "audit line one\n", string(content))
+
+	// the size limit rotates inline, sealing the first line into the backup
+	_, err = logger.Write([]byte("audit line two, over the limit\n"))
+	assert.Nil(t, err)
+	files, err := filepath.Glob(rule.backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	sealed, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "audit line one\n", string(sealed))
+	content, err = os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "audit line two, over the limit\n", string(content))
+	waitForRotation(logger)
+
+	assert.Nil(t, logger.Close())
+	_, err = logger.Write([]byte("after close\n"))
+	assert.ErrorIs(t, err, ErrLogFileClosed)
+}
+
+func TestRotateLoggerTailRepair(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "clean file untouched",
+			content: `{"level":"info"}` + "\n",
+			want:    `{"level":"info"}` + "\n",
+		},
+		{
+			name:    "complete record missing newline",
+			content: `{"level":"info"}` + "\n" + `{"level":"error"}`,
+			want:    `{"level":"info"}` + "\n" + `{"level":"error"}` + "\n",
+		},
+		{
+			name:    "partial record truncated",
+			content: `{"level":"info"}` + "\n" + `{"lev`,
+			want:    `{"level":"info"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "repair.log")
+			assert.Nil(t, os.WriteFile(filename, []byte(test.content), 0o600))
+
+			rule := DefaultRotateRule(filename, backupFileDelimiter, 0, false)
+			logger, err := NewLogger(filename, rule, false, WithTailRepair())
+			assert.Nil(t, err)
+			assert.Nil(t, logger.Close())
+
+			content, err := os.ReadFile(filename)
+			assert.Nil(t, err)
+			assert.Equal(t, test.want, string(content))
+		})
+	}
+}
+
+func TestRotateLoggerReconfigureConcurrentReads(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reconf-race.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the rule readers off the worker goroutine must tolerate a concurrent swap
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for i := 0; i < 20; i++ {
+			logger.PendingDeletions()
+			logger.DiskUsage()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, logger.Reconfigure(LogConf{
+			RotationRuleType: LogRotationRuleTypeSizeLimit,
+			MaxSize:          1,
+		}))
+	}
+	group.Wait()
+}
+
+func TestRotateLoggerReconfigure(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "reconf.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, false), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	assert.ErrorIs(t, logger.Reconfigure(LogConf{KeepDays: -1}), ErrNegativeKeepDays)
+
+	assert.Nil(t, logger.Reconfigure(LogConf{
+		RotationRuleType: LogRotationRuleTypeSizeLimit,
+		MaxSize:          1,
+		MaxBackups:       3,
+	}))
+	rule, ok := logger.rule.(*SizeLimitRotateRule)
+	assert.True(t, ok)
+	assert.Equal(t, 1, rule.maxSize)
+
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write(make([]byte, megabyte))
+	logger.write([]byte("over the size limit\n"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&logger.stats.rotations))
+	files, err := filepath.Glob(rule.backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	waitForRotation(logger)
+
+	// every configured rule type survives a reconfigure, not just the common two
+	assert.Nil(t, logger.Reconfigure(LogConf{RotationRuleType: LogRotationRuleTypeHourly}))
+	_, isHourly := logger.rule.(*HourlyRotateRule)
+	assert.True(t, isHourly)
+
+	assert.Nil(t, logger.Reconfigure(LogConf{RotationRuleType: LogRotationRuleTypeWeekly}))
+	_, isWeekly := logger.rule.(*WeeklyRotateRule)
+	assert.True(t, isWeekly)
+
+	assert.Nil(t, logger.Reconfigure(LogConf{
+		RotationRuleType: LogRotationRuleTypeCron,
+		RotationCronSpec: "0 0 * * *",
+	}))
+	_, isCron := logger.rule.(*CronRotateRule)
+	assert.True(t, isCron)
+
+	assert.Nil(t, logger.Close())
+	assert.ErrorIs(t, logger.Reconfigure(LogConf{}), ErrLogFileClosed)
 }
 
-func TestDailyRotateRuleShallRotate(t *testing.T) {
-	var rule DailyRotateRule
-	rule.rotatedTime = time.Now().Add(time.Hour * 24).Format(dateFormat)
-	assert.True(t, rule.ShallRotate(0, 0))
+func TestRotateLoggerSetRule(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "setrule.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, false), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	assert.ErrorIs(t, logger.SetRule(nil), ErrNilRotateRule)
+
+	sized := NewSizeLimitRotateRuleBytes(filename, backupFileDelimiter, 0, 32, 3, 0, false)
+	assert.Nil(t, logger.SetRule(sized))
+
+	// the following write calls cannot be changed to Write, because of DATA RACE.
+	logger.write([]byte("a line under the limit\n"))
+	logger.write([]byte("pushes past the limit\n"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&logger.stats.rotations))
+	files, err := filepath.Glob(sized.(*SizeLimitRotateRule).backupPattern(false))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	waitForRotation(logger)
+
+	assert.Nil(t, logger.Close())
+	assert.ErrorIs(t, logger.SetRule(sized), ErrLogFileClosed)
 }
 
-func TestSizeLimitRotateRuleMarkRotated(t *testing.T) {
-	var rule SizeLimitRotateRule
-	rule.MarkRotated()
-	assert.Equal(t, getNowDateInRFC3339Format(), rule.rotatedTime)
+func TestRotateLoggerOnRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hook.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 0, true)
+
+	type rotation struct {
+		oldFile string
+		newFile string
+	}
+	events := make(chan rotation, 1)
+	logger, err := NewLogger(filename, rule, true,
+		WithOnRotate(func(oldFile, newFile string) {
+			events <- rotation{oldFile: oldFile, newFile: newFile}
+		}))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("ship me\n"))
+	assert.Nil(t, err)
+	backup := rule.BackupFileName()
+	_, err = logger.RotateAndCapture()
+	assert.Nil(t, err)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, filename, event.oldFile)
+		assert.Equal(t, backup+gzipExt, event.newFile)
+		_, err = os.Stat(event.newFile)
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("OnRotate callback not invoked")
+	}
 }
 
-func TestSizeLimitRotateRuleOutdatedFiles(t *testing.T) {
-	var rule SizeLimitRotateRule
-	assert.Empty(t, rule.OutdatedFiles())
-	rule.days = 1
-	assert.Empty(t, rule.OutdatedFiles())
-	rule.gzip = true
-	assert.Empty(t, rule.OutdatedFiles())
-	rule.maxBackups = 0
-	assert.Empty(t, rule.OutdatedFiles())
+type fakeZstdCompressor struct{}
+
+func (fakeZstdCompressor) Compress(src string) (string, error) {
+	dst := src + ".zst"
+	return dst, os.Rename(src, dst)
 }
 
-func TestSizeLimitRotateRuleShallRotate(t *testing.T) {
-	var rule SizeLimitRotateRule
-	rule.rotatedTime = time.Now().Add(time.Hour * 24).Format(rfc3339DateFormat)
-	rule.maxSize = 0
-	assert.False(t, rule.ShallRotate(0, 0))
-	rule.maxSize = 100
-	assert.False(t, rule.ShallRotate(0, 0))
-	assert.True(t, rule.ShallRotate(99*megabyte, 2*megabyte))
+func (fakeZstdCompressor) Extension() string {
+	return ".zst"
 }
 
-func TestRotateLoggerClose(t *testing.T) {
-	filename, err := fs.TempFilenameWithText("foo")
+func TestRotateLoggerWithCompressor(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "codec.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, true)
+	logger, err := NewLogger(filename, rule, true, WithCompressor(fakeZstdCompressor{}))
 	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer os.Remove(filename)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("codec content\n"))
+	assert.Nil(t, err)
+	_, err = logger.RotateAndCapture()
+	assert.Nil(t, err)
+
+	// the backup carries the codec extension instead of .gz
+	target := rule.BackupFileName() + ".zst"
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(target); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
 	}
-	logger, err := NewLogger(filename, new(DailyRotateRule), false)
 	assert.Nil(t, err)
+
+	// retention matches the codec extension in its glob patterns
+	daily := rule.(*DailyRotateRule)
+	assert.Contains(t, daily.backupPattern(true), ".zst")
+	outdated := daily.backupFileNameAt(time.Now().Add(-3*hoursPerDay*time.Hour)) + ".zst"
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Contains(t, rule.OutdatedFiles(), outdated)
+	waitForRotation(logger)
+
+	// the built-in gzip codec round trips
+	src := filepath.Join(dir, "plain.log")
+	assert.Nil(t, os.WriteFile(src, []byte("gzip me"), 0o644))
+	dst, err := NewGzipCompressor(gzip.DefaultCompression).Compress(src)
+	assert.Nil(t, err)
+	assert.Equal(t, src+gzipExt, dst)
+	f, err := os.Open(dst)
+	assert.Nil(t, err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	defer gr.Close()
+	data, err := io.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, "gzip me", string(data))
+}
+
+func TestRotateLoggerCompressLevel(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "level.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, true),
+		true, WithCompressLevel(gzip.BestSpeed))
+	assert.Nil(t, err)
+	assert.Equal(t, gzip.BestSpeed, logger.compressLevel)
 	assert.Nil(t, logger.Close())
+
+	// an illegal level falls back to the default
+	logger, err = NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, true),
+		true, WithCompressLevel(42))
+	assert.Nil(t, err)
+	assert.Equal(t, gzip.DefaultCompression, logger.compressLevel)
+	assert.Nil(t, logger.Close())
+
+	// the archive produced at best speed still round trips
+	file := filepath.Join(t.TempDir(), "speed.log")
+	content := strings.Repeat("compressible content\n", 1024)
+	assert.Nil(t, os.WriteFile(file, []byte(content), 0o644))
+	assert.Nil(t, gzipFile(file, make([]byte, defaultCopyBufferSize),
+		CompressConflictRename, 0, gzip.BestSpeed))
+	f, err := os.Open(file + gzipExt)
+	assert.Nil(t, err)
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	defer gr.Close()
+	data, err := io.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
 }
 
-func TestRotateLoggerGetBackupFilename(t *testing.T) {
-	filename, err := fs.TempFilenameWithText("foo")
+func TestRotateLoggerEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	dir := t.TempDir()
+
+	// round trip through the file level helpers
+	file := filepath.Join(dir, "roundtrip.log")
+	assert.Nil(t, os.WriteFile(file, []byte("top secret"), 0o644))
+	assert.Nil(t, encryptLogFile(file, key))
+	_, err := os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	encrypted, err := os.ReadFile(file + encExt)
 	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer os.Remove(filename)
+	assert.NotContains(t, string(encrypted), "top secret")
+	plain, err := DecryptLogFile(file+encExt, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "top secret", string(plain))
+
+	// the wrong key never decrypts
+	_, err = DecryptLogFile(file+encExt, []byte("fedcba9876543210"))
+	assert.NotNil(t, err)
+
+	// compressed then encrypted backups decompress transparently
+	zipped := filepath.Join(dir, "compressed.log")
+	assert.Nil(t, os.WriteFile(zipped, []byte("zipped secret"), 0o644))
+	assert.Nil(t, gzipFile(zipped, make([]byte, defaultCopyBufferSize), CompressConflictRename, 0, gzip.DefaultCompression))
+	assert.Nil(t, encryptLogFile(zipped+gzipExt, key))
+	plain, err = DecryptLogFile(zipped+gzipExt+encExt, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "zipped secret", string(plain))
+
+	// rotated backups are encrypted in postRotate
+	filename := filepath.Join(dir, "secret.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 1, false)
+	logger, err := NewLogger(filename, rule, false, WithEncryption(key))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	_, err = logger.Write([]byte("sensitive line\n"))
+	assert.Nil(t, err)
+	data, err := logger.RotateAndCapture()
+	assert.Nil(t, err)
+
+	target := rule.BackupFileName() + encExt
+	for i := 0; i < 100; i++ {
+		if plain, err = DecryptLogFile(target, key); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
 	}
-	logger, err := NewLogger(filename, new(DailyRotateRule), false)
 	assert.Nil(t, err)
-	assert.True(t, len(logger.getBackupFilename()) > 0)
-	logger.backup = ""
-	assert.True(t, len(logger.getBackupFilename()) > 0)
+	assert.Equal(t, data, plain)
+
+	// retention matches the encrypted extension
+	daily := rule.(*DailyRotateRule)
+	outdated := daily.backupFileNameAt(time.Now().Add(-3*hoursPerDay*time.Hour)) + encExt
+	assert.Nil(t, os.WriteFile(outdated, []byte("x"), 0o644))
+	assert.Contains(t, rule.OutdatedFiles(), outdated)
+	waitForRotation(logger)
 }
 
-func TestRotateLoggerMayCompressFile(t *testing.T) {
-	old := os.Stdout
-	os.Stdout = os.NewFile(0, os.DevNull)
+func TestCronRotateRule(t *testing.T) {
 	defer func() {
-		os.Stdout = old
+		timeNow = time.Now
 	}()
 
-	filename, err := fs.TempFilenameWithText("foo")
-	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer os.Remove(filename)
-	}
-	logger, err := NewLogger(filename, new(DailyRotateRule), false)
+	// 2023-06-02 is a Friday
+	now := time.Date(2023, time.June, 2, 13, 0, 0, 0, time.Local)
+	timeNow = func() time.Time { return now }
+
+	filename := filepath.Join(t.TempDir(), "cron.log")
+	rule, err := NewCronRotateRule(filename, backupFileDelimiter, "0 0,12 * * *", 0, 0, false)
 	assert.Nil(t, err)
-	logger.maybeCompressFile(filename)
-	_, err = os.Stat(filename)
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// the next boundary, Saturday midnight, has passed
+	now = now.Add(11 * time.Hour)
+	assert.True(t, rule.ShallRotate(0, 0))
+	rule.MarkRotated()
+	assert.False(t, rule.ShallRotate(0, 0))
+
+	// weekdays only: Saturday and Sunday are skipped, Monday midnight fires
+	weekdays, err := NewCronRotateRule(filename, backupFileDelimiter, "0 0 * * 1-5", 0, 0, false)
 	assert.Nil(t, err)
+	now = now.Add(24 * time.Hour) // Sunday midnight
+	assert.False(t, weekdays.ShallRotate(0, 0))
+	now = now.Add(24 * time.Hour) // Monday midnight
+	assert.True(t, weekdays.ShallRotate(0, 0))
+
+	// invalid specs are rejected
+	_, err = NewCronRotateRule(filename, backupFileDelimiter, "not a cron spec", 0, 0, false)
+	assert.NotNil(t, err)
+	_, err = NewCronRotateRule(filename, backupFileDelimiter, "61 * * * *", 0, 0, false)
+	assert.NotNil(t, err)
+	_, err = NewCronRotateRule(filename, backupFileDelimiter, "* * * * */0", 0, 0, false)
+	assert.NotNil(t, err)
 }
 
-func TestRotateLoggerMayCompressFileTrue(t *testing.T) {
-	old := os.Stdout
-	os.Stdout = os.NewFile(0, os.DevNull)
-	defer func() {
-		os.Stdout = old
-	}()
+func TestRotateLoggerRecordSeparator(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "framed.log")
+	rule := DefaultRotateRule(filename, backupFileDelimiter, 0, false)
+	logger, err := NewLogger(filename, rule, false, WithRecordSeparator([]byte{0}))
+	assert.Nil(t, err)
+	defer logger.Close()
 
-	filename, err := fs.TempFilenameWithText("foo")
+	_, err = logger.Write([]byte("first"))
 	assert.Nil(t, err)
-	logger, err := NewLogger(filename, new(DailyRotateRule), true)
+	_, err = logger.Write(append([]byte("second"), 0))
 	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
+
+	// records stay framed in the sealed backup
+	data, err := logger.RotateAndCapture()
+	assert.Nil(t, err)
+	assert.Equal(t, "first\x00second\x00", string(data))
+
+	// and in the active file after the rotation
+	_, err = logger.Write([]byte("third"))
+	assert.Nil(t, err)
+	assert.Nil(t, logger.Close())
+	content, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "third\x00", string(content))
+}
+
+func TestRotateLoggerStats(t *testing.T) {
+	var recorder latencyRecorder
+	for i := 1; i <= 100; i++ {
+		recorder.record(time.Duration(i) * time.Millisecond)
 	}
-	logger.maybeCompressFile(filename)
-	_, err = os.Stat(filename)
-	assert.NotNil(t, err)
+	snapshot := recorder.snapshot()
+	assert.Equal(t, 50*time.Millisecond, snapshot.P50)
+	assert.Equal(t, 95*time.Millisecond, snapshot.P95)
+	assert.Equal(t, 100*time.Millisecond, snapshot.Max)
+
+	// an empty recorder reports zeros
+	var empty latencyRecorder
+	assert.Equal(t, LatencySnapshot{}, empty.snapshot())
+
+	// once the window wraps, only the most recent samples are reported
+	for i := 0; i < latencySampleCount; i++ {
+		recorder.record(time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond, recorder.snapshot().Max)
+
+	filename := filepath.Join(t.TempDir(), "stats.log")
+	logger, err := NewLogger(filename, DefaultRotateRule(filename, backupFileDelimiter, 0, false), false)
+	assert.Nil(t, err)
+	defer logger.Close()
+	_, err = logger.Write([]byte("observe\n"))
+	assert.Nil(t, err)
+	_, err = logger.RotateAndCapture()
+	assert.Nil(t, err)
+	stats := logger.Stats()
+	assert.True(t, stats.WriteLatency.Max > 0)
+	assert.True(t, stats.RotateDuration.Max > 0)
 }
 
-func TestRotateLoggerRotate(t *testing.T) {
-	filename, err := fs.TempFilenameWithText("foo")
+func TestRotateLoggerTrashRetention(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "trash.log")
+	rule := NewSizeLimitRotateRule(filename, backupFileDelimiter, 1, 100, 1, 0, false)
+	logger, err := NewLogger(filename, rule, false, WithTrashRetention(time.Hour))
 	assert.Nil(t, err)
-	logger, err := NewLogger(filename, new(DailyRotateRule), true)
+	defer logger.Close()
+
+	// with maxBackups 1, the older of the two backups goes to the trash
+	sizeRule := rule.(*SizeLimitRotateRule)
+	older := sizeRule.backupFileNameAt(time.Now().Add(-2 * time.Hour))
+	newer := sizeRule.backupFileNameAt(time.Now().Add(-time.Hour))
+	assert.Nil(t, os.WriteFile(older, []byte("old"), 0o644))
+	assert.Nil(t, os.WriteFile(newer, []byte("new"), 0o644))
+
+	logger.maybeDeleteOutdatedFiles()
+	trashed := filepath.Join(dir, trashDirName, filepath.Base(older))
+	_, err = os.Stat(trashed)
 	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer func() {
-			os.Remove(logger.getBackupFilename())
-			os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
-		}()
+	_, err = os.Stat(trashed + tombstoneExt)
+	assert.Nil(t, err)
+	_, err = os.Stat(older)
+	assert.True(t, os.IsNotExist(err))
+
+	// within the grace period, the sweep keeps the trashed file
+	logger.maybeDeleteOutdatedFiles()
+	_, err = os.Stat(trashed)
+	assert.Nil(t, err)
+
+	// past the grace period, the sweep hard-deletes the file and its tombstone
+	timeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	defer func() { timeNow = time.Now }()
+	logger.maybeDeleteOutdatedFiles()
+	_, err = os.Stat(trashed)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(trashed + tombstoneExt)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&logger.stats.deletions))
+}
+
+type blockedRotateRule struct {
+	DailyRotateRule
+	gate chan lang.PlaceholderType
+}
+
+func (r *blockedRotateRule) ShallRotate(_, _ int) bool {
+	<-r.gate
+	return false
+}
+
+func TestRotateLoggerAdaptiveSampling(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "adaptive.log")
+	rule := &blockedRotateRule{
+		DailyRotateRule: DailyRotateRule{
+			rotatedTime: getNowDate(),
+			filename:    filename,
+			delimiter:   backupFileDelimiter,
+		},
+		gate: make(chan lang.PlaceholderType),
 	}
-	err = logger.rotate()
-	switch v := err.(type) {
-	case *os.LinkError:
-		// avoid rename error on docker container
-		assert.Equal(t, syscall.EXDEV, v.Err)
-	case *os.PathError:
-		// ignore remove error for tests,
-		// files are cleaned in GitHub actions.
-		assert.Equal(t, "remove", v.Op)
-	default:
+	logger, err := NewLogger(filename, rule, false, WithAdaptiveSampling(1))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the worker blocks in ShallRotate, so the channel stays full
+	for i := 0; i < bufferSize+2; i++ {
+		_, err = logger.Write([]byte("sustained fullness\n"))
 		assert.Nil(t, err)
 	}
+	assert.True(t, logger.Sampling())
+	assert.True(t, atomic.LoadInt64(&logger.stats.dropped) > 0)
+
+	// release the worker and wait for the channel to drain
+	close(rule.gate)
+	for i := 0; len(logger.channel) > 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, err = logger.Write([]byte("back to normal\n"))
+	assert.Nil(t, err)
+	assert.False(t, logger.Sampling())
 }
 
-func TestRotateLoggerWrite(t *testing.T) {
+func TestRotateLoggerManifestChain(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "app.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithManifest(true))
+	assert.Nil(t, err)
+	defer logger.Close()
+
+	// the following calls cannot race with Write, same as the write calls below.
+	logger.appendManifest(filename + ".2023-01-01")
+	logger.appendManifest(filename + ".2023-01-02")
+	logger.appendManifest(filename + ".2023-01-03")
+	manifest := filename + manifestExt
+	assert.Nil(t, VerifyManifest(manifest))
+
+	// altering a record breaks the chain
+	content, err := os.ReadFile(manifest)
+	assert.Nil(t, err)
+	tampered := bytes.Replace(content, []byte("2023-01-02"), []byte("2023-01-04"), 1)
+	assert.Nil(t, os.WriteFile(manifest, tampered, 0o600))
+	assert.NotNil(t, VerifyManifest(manifest))
+}
+
+func TestRotateLoggerDiscardOnClosed(t *testing.T) {
+	var buf bytes.Buffer
+	old := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(old)
+
+	filename := filepath.Join(t.TempDir(), "discard.log")
+	logger, err := NewLogger(filename, new(DailyRotateRule), false, WithDiscardOnClosed())
+	assert.Nil(t, err)
+	assert.Nil(t, logger.Close())
+
+	n, err := logger.Write([]byte("too late"))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, ErrLogFileClosed)
+	assert.Empty(t, buf.String())
+
+	// without the option the rejected line still goes to the standard logger
+	loud, err := NewLogger(filename, new(DailyRotateRule), false)
+	assert.Nil(t, err)
+	assert.Nil(t, loud.Close())
+	n, err = loud.Write([]byte("too late"))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, ErrLogFileClosed)
+	assert.Contains(t, buf.String(), "too late")
+}
+
+func TestRotateLoggerWriteWhileClosing(t *testing.T) {
+	old := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(old)
+
 	filename, err := fs.TempFilenameWithText("foo")
 	assert.Nil(t, err)
-	rule := new(DailyRotateRule)
-	logger, err := NewLogger(filename, rule, true)
+	defer os.Remove(filename)
+	logger, err := NewLogger(filename, new(DailyRotateRule), false)
 	assert.Nil(t, err)
-	if len(filename) > 0 {
-		defer func() {
-			os.Remove(logger.getBackupFilename())
-			os.Remove(filepath.Base(logger.getBackupFilename()) + ".gz")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var failed bool
+			for j := 0; j < 100; j++ {
+				if _, err := logger.Write([]byte("foo\n")); err != nil {
+					assert.Equal(t, ErrLogFileClosed, err)
+					failed = true
+				} else {
+					// writes never succeed again once the closed branch is taken
+					assert.False(t, failed)
+				}
+			}
 		}()
 	}
-	// the following write calls cannot be changed to Write, because of DATA RACE.
-	logger.write([]byte(`foo`))
-	rule.rotatedTime = time.Now().Add(-time.Hour * 24).Format(dateFormat)
-	logger.write([]byte(`bar`))
-	logger.Close()
-	logger.write([]byte(`baz`))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, logger.Close())
+	wg.Wait()
+
+	n, err := logger.Write([]byte("bar\n"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, ErrLogFileClosed, err)
 }
 
 func TestLogWriterClose(t *testing.T) {
@@ -195,10 +3025,13 @@ func TestRotateLoggerGetBackupWithSizeLimitRotateRuleFilename(t *testing.T) {
 }
 
 func TestRotateLoggerWithSizeLimitRotateRuleMayCompressFile(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
 	old := os.Stdout
-	os.Stdout = os.NewFile(0, os.DevNull)
+	os.Stdout = null
 	defer func() {
 		os.Stdout = old
+		null.Close()
 	}()
 
 	filename, err := fs.TempFilenameWithText("foo")
@@ -214,10 +3047,13 @@ func TestRotateLoggerWithSizeLimitRotateRuleMayCompressFile(t *testing.T) {
 }
 
 func TestRotateLoggerWithSizeLimitRotateRuleMayCompressFileTrue(t *testing.T) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	assert.Nil(t, err)
 	old := os.Stdout
-	os.Stdout = os.NewFile(0, os.DevNull)
+	os.Stdout = null
 	defer func() {
 		os.Stdout = old
+		null.Close()
 	}()
 
 	filename, err := fs.TempFilenameWithText("foo")
@@ -277,6 +3113,44 @@ func TestRotateLoggerWithSizeLimitRotateRuleWrite(t *testing.T) {
 	logger.write([]byte(`baz`))
 }
 
+func BenchmarkCompressWithCopyBufferPool(b *testing.B) {
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.FailNow()
+	}
+	old := os.Stdout
+	os.Stdout = null
+	defer func() {
+		os.Stdout = old
+		null.Close()
+	}()
+
+	filename, err := fs.TempFilenameWithText("foo")
+	if err != nil {
+		b.FailNow()
+	}
+	defer os.Remove(filename)
+	logger, err := NewLogger(filename, new(DailyRotateRule), true, WithCopyBufferSize(16*1024))
+	if err != nil {
+		b.FailNow()
+	}
+	defer logger.Close()
+
+	content := strings.Repeat("any content\n", 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			file, err := fs.TempFilenameWithText(content)
+			if err != nil {
+				b.FailNow()
+			}
+			logger.maybeCompressFile(file)
+			os.Remove(file + gzipExt)
+		}
+	})
+}
+
 func BenchmarkRotateLogger(b *testing.B) {
 	filename := "./test.log"
 	filename2 := "./test2.log"
@@ -302,6 +3176,7 @@ func BenchmarkRotateLogger(b *testing.B) {
 			1,
 			100,
 			10,
+			0,
 			true,
 		),
 		true,
@@ -328,3 +3203,37 @@ func BenchmarkRotateLogger(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkRotateLoggerBatchedWrite(b *testing.B) {
+	line := []byte("testing\ntesting\n")
+
+	b.Run("unbatched", func(b *testing.B) {
+		filename := filepath.Join(b.TempDir(), "plain.log")
+		logger, err := NewLogger(filename,
+			DefaultRotateRule(filename, backupFileDelimiter, 1, false), false)
+		if err != nil {
+			b.FailNow()
+		}
+		defer logger.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			logger.Write(line)
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		filename := filepath.Join(b.TempDir(), "batch.log")
+		logger, err := NewLogger(filename,
+			DefaultRotateRule(filename, backupFileDelimiter, 1, false), false,
+			WithBatchSize(64*1024))
+		if err != nil {
+			b.FailNow()
+		}
+		defer logger.Close()
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			logger.Write(line)
+		}
+	})
+}
@@ -48,6 +48,7 @@ const (
 	contentKey   = "content"
 	durationKey  = "duration"
 	levelKey     = "level"
+	rotatedKey   = "_rotated"
 	spanKey      = "span"
 	timestampKey = "@timestamp"
 	traceKey     = "trace"
@@ -58,4 +59,22 @@ var (
 	ErrLogPathNotSet = errors.New("log path must be set")
 	// ErrLogServiceNameNotSet is an error that indicates that the service name is not set.
 	ErrLogServiceNameNotSet = errors.New("log service name must be set")
+	// ErrNegativeKeepDays is an error that indicates the keep days is negative.
+	ErrNegativeKeepDays = errors.New("KeepDays must be non-negative")
+	// ErrNegativeKeepMonths is an error that indicates the keep months is negative.
+	ErrNegativeKeepMonths = errors.New("KeepMonths must be non-negative")
+	// ErrNegativeKeepHours is an error that indicates the keep hours is negative.
+	ErrNegativeKeepHours = errors.New("KeepHours must be non-negative")
+	// ErrNegativeKeepDuration is an error that indicates the keep duration is negative.
+	ErrNegativeKeepDuration = errors.New("KeepDuration must be non-negative")
+	// ErrNegativeMaxBackups is an error that indicates the max backups is negative.
+	ErrNegativeMaxBackups = errors.New("MaxBackups must be non-negative")
+	// ErrNegativeMaxSize is an error that indicates the max size is negative.
+	ErrNegativeMaxSize = errors.New("MaxSize must be non-negative")
+	// ErrNegativeMaxTotalSize is an error that indicates the max total size is negative.
+	ErrNegativeMaxTotalSize = errors.New("MaxTotalSize must be non-negative")
+	// ErrEmptyBackupDelimiter is an error that indicates the backup delimiter is empty.
+	ErrEmptyBackupDelimiter = errors.New("backup delimiter must not be empty")
+	// ErrNilRotateRule is an error that indicates the rotate rule is nil.
+	ErrNilRotateRule = errors.New("rotate rule must not be nil")
 )
@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 
 	"github.com/zeromicro/go-zero/core/color"
+	"github.com/zeromicro/go-zero/core/sysx"
 )
 
 type (
@@ -75,9 +76,13 @@ func (w *atomicWriter) Swap(v Writer) Writer {
 	return old
 }
 
-func newConsoleWriter() Writer {
-	outLog := newLogWriter(log.New(os.Stdout, "", flags))
-	errLog := newLogWriter(log.New(os.Stderr, "", flags))
+// NewRoutedWriter creates a Writer that routes by level: info and stat lines
+// go to out, while error, severe, slow and stack lines go to err. The console
+// mode uses it with os.Stdout and os.Stderr, so collectors reading the two
+// streams separate errors from regular output cleanly.
+func NewRoutedWriter(out, err io.Writer) Writer {
+	outLog := newLogWriter(log.New(out, "", flags))
+	errLog := newLogWriter(log.New(err, "", flags))
 	return &concreteWriter{
 		infoLog:   outLog,
 		errorLog:  errLog,
@@ -88,6 +93,10 @@ func newConsoleWriter() Writer {
 	}
 }
 
+func newConsoleWriter() Writer {
+	return NewRoutedWriter(os.Stdout, os.Stderr)
+}
+
 func newFileWriter(c LogConf) (Writer, error) {
 	var err error
 	var opts []LogOption
@@ -103,20 +112,87 @@ func newFileWriter(c LogConf) (Writer, error) {
 	}
 
 	opts = append(opts, WithCooldownMillis(c.StackCooldownMillis))
+	if c.BufferSize > 0 {
+		opts = append(opts, WithLogBufferSize(c.BufferSize))
+	}
 	if c.Compress {
 		opts = append(opts, WithGzip())
+		// zero is treated as unset, keeping directly constructed configs
+		// on the default compression level
+		if c.CompressLevel != 0 {
+			opts = append(opts, WithGzipLevel(c.CompressLevel))
+		}
+	}
+	if c.CompressConcurrency > 0 {
+		opts = append(opts, WithCompressConcurrency(c.CompressConcurrency))
+	}
+	if c.CompressAfter > 0 {
+		opts = append(opts, WithCompressAfter(c.CompressAfter))
+	}
+	if c.CompressExisting {
+		opts = append(opts, WithCompressExisting())
 	}
 	if c.KeepDays > 0 {
 		opts = append(opts, WithKeepDays(c.KeepDays))
 	}
+	if c.KeepMonths > 0 {
+		opts = append(opts, WithKeepMonths(c.KeepMonths))
+	}
+	if c.KeepHours > 0 {
+		opts = append(opts, WithKeepHours(c.KeepHours))
+	}
+	if c.KeepDuration > 0 {
+		opts = append(opts, WithKeepDuration(c.KeepDuration))
+	}
+	if c.Exclusive {
+		opts = append(opts, WithExclusive())
+	}
+	if c.RepairOnOpen {
+		opts = append(opts, WithRepairOnOpen())
+	}
+	if c.Synchronous {
+		opts = append(opts, WithSynchronous())
+	}
 	if c.MaxBackups > 0 {
 		opts = append(opts, WithMaxBackups(c.MaxBackups))
 	}
 	if c.MaxSize > 0 {
 		opts = append(opts, WithMaxSize(c.MaxSize))
 	}
+	if c.MaxTotalSize > 0 {
+		opts = append(opts, WithMaxTotalSize(c.MaxTotalSize))
+	}
 
 	opts = append(opts, WithLogRotationRuleType(c.RotationRuleType))
+	if len(c.RotationCronSpec) > 0 {
+		opts = append(opts, WithLogRotationCronSpec(c.RotationCronSpec))
+	}
+	if c.SymlinkCurrent {
+		opts = append(opts, WithSymlinkCurrent())
+	}
+	if c.RotationMarker {
+		opts = append(opts, WithRotationMarker())
+	}
+	if c.UTC {
+		opts = append(opts, WithUTC())
+	}
+	if mode, err := parseFileMode(c.FileMode); err != nil {
+		return nil, err
+	} else if mode != 0 {
+		opts = append(opts, WithLogFileMode(mode))
+	}
+	if mode, err := parseFileMode(c.DirMode); err != nil {
+		return nil, err
+	} else if mode != 0 {
+		opts = append(opts, WithLogDirMode(mode))
+	}
+
+	// replicas share the mounted volume, qualify backups to keep them apart
+	var qualifier string
+	if c.Mode == volumeMode {
+		qualifier = sysx.Hostname()
+	}
+	opts = append(opts, WithBackupQualifier(qualifier))
 
 	accessFile := path.Join(c.Path, accessFilename)
 	errorFile := path.Join(c.Path, errorFilename)
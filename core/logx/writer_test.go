@@ -93,6 +93,25 @@ func TestConsoleWriter(t *testing.T) {
 	w.(*concreteWriter).statLog = easyToCloseWriter{}
 }
 
+func TestRoutedWriter(t *testing.T) {
+	var out, errOut bytes.Buffer
+	w := NewRoutedWriter(&out, &errOut)
+
+	w.Info("info goes to stdout")
+	assert.Contains(t, out.String(), "info goes to stdout")
+	assert.Empty(t, errOut.String())
+
+	w.Error("error goes to stderr")
+	assert.Contains(t, errOut.String(), "error goes to stderr")
+	assert.NotContains(t, out.String(), "error goes to stderr")
+
+	w.Stat("stat goes to stdout")
+	assert.Contains(t, out.String(), "stat goes to stdout")
+
+	w.Severe("severe goes to stderr")
+	assert.Contains(t, errOut.String(), "severe goes to stderr")
+}
+
 func TestNopWriter(t *testing.T) {
 	assert.NotPanics(t, func() {
 		var w nopWriter